@@ -0,0 +1,89 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package basetest allows testing of the code that uses base's pipes, metrics and logger
+// without real ports and without port.json:
+//
+//	func TestSomething(t *testing.T) {
+//		kit := basetest.New(t)
+//		base.CreateNewCounter("jobs", "Jobs", "count").Add(1)
+//		kit.AssertMetric("jobs", "1")
+//		base.Errorf("oops")
+//		kit.AssertContains(base.Stderr, "oops")
+//	}
+package basetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nontechno/base"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+)
+
+// ties the fake receiver and the loopback transport together
+type Kit struct {
+	*Receiver
+	Loopback *Loopback
+
+	// how long the assertions wait for the expected data to arrive
+	Timeout time.Duration
+
+	t        testing.TB
+	previous base.Dialer
+}
+
+// resets base's global state and connects its pipes to a fake receiver through an in-memory transport;
+// everything is undone when the test completes
+func New(t testing.TB) *Kit {
+	base.ResetState()
+
+	receiver := NewReceiver()
+	kit := &Kit{
+		Receiver: receiver,
+		Loopback: NewLoopback(receiver.Connect),
+		Timeout:  defaultTimeout,
+		t:        t,
+	}
+
+	kit.previous = base.SetDialer(kit.Loopback.Dial)
+	base.ConnectPipes(0)
+
+	t.Cleanup(kit.Close)
+	return kit
+}
+
+func (kit *Kit) Close() {
+	base.ResetState()
+	base.SetDialer(kit.previous)
+	kit.Loopback.Close()
+}
+
+// fails the test if the metric has not reached the specified value within the timeout
+func (kit *Kit) AssertMetric(id, value string) {
+	kit.t.Helper()
+	if !kit.WaitFor(func() bool { return kit.MetricReached(id, value) }, kit.Timeout) {
+		last, _ := kit.Metric(id)
+		kit.t.Errorf("metric (%s) has not reached value (%s), last value: (%s)", id, value, last)
+	}
+}
+
+// fails the test if the stream does not contain the text within the timeout
+func (kit *Kit) AssertContains(stream int, text string) {
+	kit.t.Helper()
+	if !kit.WaitFor(func() bool { return kit.Contains(stream, text) }, kit.Timeout) {
+		kit.t.Errorf("stream (%d) does not contain (%s)", stream, text)
+	}
+}
+
+// fails the test if no connection was made within the timeout
+func (kit *Kit) AssertConnected() {
+	kit.t.Helper()
+	if !kit.WaitFor(func() bool { return len(kit.Fingerprints()) > 0 }, kit.Timeout) {
+		kit.t.Errorf("no connection has been made")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package basetest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+func TestAssertMetric(t *testing.T) {
+	kit := basetest.New(t)
+
+	jobs := base.CreateNewCounter("jobs", "Jobs", "count")
+	jobs.Add(1)
+	jobs.Add(2)
+
+	kit.AssertMetric("jobs", "3")
+	kit.AssertConnected()
+}
+
+func TestAssertContains(t *testing.T) {
+	kit := basetest.New(t)
+
+	base.Printf("hello %s\n", "out")
+	base.Errorf("oops: %d\n", 42)
+
+	kit.AssertContains(base.Stdout, "hello out")
+	kit.AssertContains(base.Stderr, "oops: 42")
+	if kit.Contains(base.Stdout, "oops") {
+		t.Errorf("stderr output got to stdout")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	kit := basetest.New(t)
+
+	status := base.CreateNewMetric("status", "Status", "")
+	status.Update("before")
+	base.Printf("before\n")
+	kit.AssertContains(base.Stdout, "before")
+	kit.AssertMetric("status", "before")
+
+	kit.Loopback.Disconnect()
+
+	// the first write after the drop fails, it is sent (along with the rest) once reconnected
+	base.Printf("after\n")
+	status.Update("after")
+
+	kit.AssertContains(base.Stdout, "after")
+	kit.AssertMetric("status", "after")
+	if kit.Disconnects() == 0 {
+		t.Errorf("the receiver has not seen the disconnect")
+	}
+	if count := len(kit.Fingerprints()); count < 2 {
+		t.Errorf("expected a reconnect, got (%d) connection(s)", count)
+	}
+}
+
+// the updates pending at the end of a test must not show up (under a reused index) in the next one
+func TestResetDropsPendingUpdates(t *testing.T) {
+	previous := basetest.New(t)
+	base.CreateNewMetric("previous", "Previous", "").Update("stale")
+	time.Sleep(100 * time.Millisecond) // the collector has it, but has not flushed it yet
+	previous.Close()
+
+	kit := basetest.New(t)
+	current := base.CreateNewMetric("current", "Current", "") // gets the index of the previous one
+	base.CreateNewCounter("flushed", "Flushed", "count").Add(1)
+	kit.AssertMetric("flushed", "1")
+	current.Update("fresh")
+	kit.AssertMetric("current", "fresh")
+
+	for _, value := range kit.MetricValues("current") {
+		if value == "stale" {
+			t.Errorf("an update of the previous test was received as (current)")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package basetest
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/nontechno/base"
+)
+
+var (
+	errLoopbackClosed = errors.New("the loopback is closed")
+)
+
+// an in-memory transport: every dial creates a net.Pipe, the other end of which is served by the receiver
+type Loopback struct {
+	maker  base.NewConnection
+	guard  sync.Mutex
+	conns  []net.Conn
+	closed bool
+}
+
+func NewLoopback(maker base.NewConnection) *Loopback {
+	return &Loopback{maker: maker}
+}
+
+// this func has the signature of base.Dialer, the port number is ignored
+func (lb *Loopback) Dial(port int) (net.Conn, error) {
+	lb.guard.Lock()
+	defer lb.guard.Unlock()
+
+	if lb.closed {
+		return nil, errLoopbackClosed
+	}
+
+	client, server := net.Pipe()
+	lb.conns = append(lb.conns, client, server)
+
+	go base.ServeConn(server, lb.maker)
+
+	return client, nil
+}
+
+// drops all the connections made so far, while allowing new ones
+func (lb *Loopback) Disconnect() {
+	lb.guard.Lock()
+	defer lb.guard.Unlock()
+
+	for _, conn := range lb.conns {
+		conn.Close()
+	}
+	lb.conns = nil
+}
+
+func (lb *Loopback) Close() error {
+	lb.Disconnect()
+
+	lb.guard.Lock()
+	lb.closed = true
+	lb.guard.Unlock()
+
+	return nil
+}
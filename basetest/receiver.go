@@ -0,0 +1,191 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package basetest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nontechno/base"
+)
+
+// a fake receiver, it records everything it gets (across all the connections)
+type Receiver struct {
+	guard        sync.Mutex
+	fingerprints []base.Fingerprint
+	frames       map[int][][]byte
+	disconnects  int
+
+	metricValues map[string][]string
+	removed      map[string]int // the number of times the metric was removed (see base.Unregister)
+}
+
+func NewReceiver() *Receiver {
+	return &Receiver{
+		frames:       make(map[int][][]byte),
+		metricValues: make(map[string][]string),
+		removed:      make(map[string]int),
+	}
+}
+
+// this func has the signature of base.NewConnection
+func (r *Receiver) Connect(props map[string]interface{}) base.Connection {
+	r.guard.Lock()
+	r.fingerprints = append(r.fingerprints, props)
+	r.guard.Unlock()
+
+	return &connection{receiver: r, metrics: base.NewMetricsDecoder(metricsSink{r})}
+}
+
+// fingerprints of all the connections so far
+func (r *Receiver) Fingerprints() []base.Fingerprint {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	return append([]base.Fingerprint(nil), r.fingerprints...)
+}
+
+func (r *Receiver) Disconnects() int {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	return r.disconnects
+}
+
+// all the frames received on the specified stream
+func (r *Receiver) Frames(stream int) [][]byte {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	return append([][]byte(nil), r.frames[stream]...)
+}
+
+// the content of the specified stream (all the frames joined together)
+func (r *Receiver) Bytes(stream int) []byte {
+	return bytes.Join(r.Frames(stream), nil)
+}
+
+func (r *Receiver) Contains(stream int, text string) bool {
+	return strings.Contains(string(r.Bytes(stream)), text)
+}
+
+// returns what was announced about the named stream (see base.OpenStream)
+func (r *Receiver) Stream(name string) (base.StreamInfo, bool) {
+	for _, frame := range r.Frames(base.Streams) {
+		if info, err := base.ParseStreamInfo(frame); err == nil && info.Name == name {
+			return info, true
+		}
+	}
+	return base.StreamInfo{}, false
+}
+
+// the latest received value of the metric with the specified id
+func (r *Receiver) Metric(id string) (string, bool) {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	values := r.metricValues[id]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// all the values received for the metric with the specified id, in order
+func (r *Receiver) MetricValues(id string) []string {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	return append([]string(nil), r.metricValues[id]...)
+}
+
+func (r *Receiver) MetricReached(id, value string) bool {
+	for _, v := range r.MetricValues(id) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the sender told the receiver to drop the metric (at least once)
+func (r *Receiver) Removed(id string) bool {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	return r.removed[id] > 0
+}
+
+// waits (up to the specified timeout) till the condition is met
+func (r *Receiver) WaitFor(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if condition() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (r *Receiver) onFrame(stream int, data []byte) {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+
+	r.frames[stream] = append(r.frames[stream], data)
+}
+
+// records the metric values (of all the connections)
+type metricsSink struct {
+	receiver *Receiver
+}
+
+func (ms metricsSink) OnDefine(id, name, units string) {}
+
+func (ms metricsSink) OnUpdate(id string, value interface{}, ts time.Time) {
+	ms.receiver.guard.Lock()
+	defer ms.receiver.guard.Unlock()
+
+	ms.receiver.metricValues[id] = append(ms.receiver.metricValues[id], formatValue(value))
+}
+
+func (ms metricsSink) OnRemove(id string) {
+	ms.receiver.guard.Lock()
+	defer ms.receiver.guard.Unlock()
+
+	ms.receiver.removed[id]++
+}
+
+func formatValue(value interface{}) string {
+	switch actual := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return actual
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+type connection struct {
+	receiver *Receiver
+	metrics  *base.MetricsDecoder // per connection, as the indexes are
+}
+
+func (c *connection) OnNewMessage(id int, data []byte) {
+	c.receiver.onFrame(id, data)
+	c.metrics.OnNewMessage(id, data)
+}
+
+func (c *connection) OnDisconnect(reason error) {
+	c.receiver.guard.Lock()
+	c.receiver.disconnects++
+	c.receiver.guard.Unlock()
+}
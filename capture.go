@@ -0,0 +1,169 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+)
+
+const (
+	fdStdout = 1
+	fdStderr = 2
+)
+
+var (
+	captureGuard sync.Mutex
+	captured     []*capturedOutput
+)
+
+type capturedOutput struct {
+	fd       int
+	kind     int      // the pipe it goes to
+	original *os.File // where the output used to go (a duplicate)
+	writer   *os.File // the writing end of the OS pipe
+	tee      bool
+	done     chan struct{}
+}
+
+// redirects the process's stdout and stderr (file descriptors 1 and 2) through OS pipes into the Stdout and Stderr pipes,
+// this covers fmt.Println, third-party libraries, cgo and the runtime; if "tee" is set, the output is also copied to where it used to go.
+// the returned func undoes the redirection and is meant to be deferred in main, in case of a panic it sends the trace
+// (and waits for it to be sent) before the panic proceeds.
+// a fatal panic on another goroutine (or a fatal runtime error) kills the process before its trace makes it through
+// the OS pipe, so the runtime is also told to write such traces to where stderr used to go (see debug.SetCrashOutput);
+// note: these traces reach the terminal (whether or not "tee" is set), but not the Stderr pipe; before go1.23 they are lost
+//
+//	if release, err := base.CaptureOutput(true); err == nil {
+//		defer release()
+//	}
+func CaptureOutput(tee bool) (func(), error) {
+	initPipes()
+
+	captureGuard.Lock()
+	defer captureGuard.Unlock()
+
+	if len(captured) > 0 {
+		return nil, errAlreadyCapturing
+	}
+
+	for _, target := range []struct{ fd, kind int }{{fdStdout, Stdout}, {fdStderr, Stderr}} {
+		output, err := captureOutput(target.fd, target.kind, tee)
+		if err != success {
+			releaseOutput()
+			return nil, err
+		}
+		captured = append(captured, output)
+	}
+
+	if err := setCrashOutput(captured[len(captured)-1].original); err != success {
+		warning("failed to set the crash output: %v\n", err)
+	}
+
+	return func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "panic: %v\n\n%s", r, debug.Stack())
+			ReleaseOutput()
+			panic(r)
+		}
+		ReleaseOutput()
+	}, success
+}
+
+// restores stdout and stderr and waits for the captured output to be sent
+func ReleaseOutput() {
+	captureGuard.Lock()
+	defer captureGuard.Unlock()
+
+	releaseOutput()
+	FlushPipes(timeoutWrite)
+}
+
+// note: expects captureGuard to be locked
+func releaseOutput() {
+	if len(captured) > 0 {
+		setCrashOutput(nil)
+	}
+	for _, output := range captured {
+		output.release()
+	}
+	captured = nil
+}
+
+func captureOutput(fd, kind int, tee bool) (*capturedOutput, error) {
+	original, err := duplicateOutput(fd)
+	if err != success {
+		return nil, err
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != success {
+		if closeDuplicateOutput {
+			original.Close()
+		}
+		return nil, err
+	}
+
+	if err := redirectOutput(fd, writer); err != success {
+		if closeDuplicateOutput {
+			original.Close()
+		}
+		reader.Close()
+		writer.Close()
+		return nil, err
+	}
+
+	output := &capturedOutput{
+		fd:       fd,
+		kind:     kind,
+		original: original,
+		writer:   writer,
+		tee:      tee,
+		done:     make(chan struct{}),
+	}
+	go output.copy(reader)
+
+	return output, success
+}
+
+func (output *capturedOutput) copy(reader *os.File) {
+	defer close(output.done)
+	defer reader.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			pipe := getPipe(output.kind) // looked up every time, as the pipes can be reconnected
+			if pipe != nil {
+				pipe.Write(buf[:n])
+			}
+			if output.tee || pipe == nil {
+				output.original.Write(buf[:n])
+			}
+		}
+		if err == io.EOF {
+			return
+		} else if err != success {
+			output.original.Write([]byte(sprintf("failed to read captured output: %v\n", err)))
+			return
+		}
+	}
+}
+
+func (output *capturedOutput) release() {
+	if err := redirectOutput(output.fd, output.original); err != success {
+		output.original.Write([]byte(sprintf("failed to restore output: %v\n", err)))
+	}
+
+	output.writer.Close() // the last writing end of the OS pipe, the reader gets EOF
+	<-output.done
+	if closeDuplicateOutput {
+		output.original.Close()
+	}
+}
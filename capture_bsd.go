@@ -0,0 +1,28 @@
+// +build darwin freebsd netbsd openbsd
+
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	closeDuplicateOutput = true
+)
+
+func duplicateOutput(fd int) (*os.File, error) {
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(dup), sprintf("/dev/fd/%d", fd)), nil
+}
+
+func redirectOutput(fd int, to *os.File) error {
+	return syscall.Dup2(int(to.Fd()), fd)
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	envCrashChild = "BASE_TEST_CRASH_CHILD"
+)
+
+// a panic on a goroutine other than main's kills the process before the deferred release runs,
+// its trace must reach the original stderr nevertheless
+func TestFatalPanicTraceIsNotLost(t *testing.T) {
+	if os.Getenv(envCrashChild) == "1" {
+		if _, err := CaptureOutput(false); err != success {
+			os.Exit(3)
+		}
+		go func() { panic("boom on a goroutine") }()
+		time.Sleep(5 * time.Second)
+		os.Exit(0)
+	}
+	if !crashOutputSupported {
+		t.Skip("the runtime cannot redirect its crash output")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFatalPanicTraceIsNotLost$")
+	cmd.Env = append(os.Environ(), envCrashChild+"=1", envPorts+"=")
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("the child was expected to crash, output: %s", output)
+	}
+	if !strings.Contains(string(output), "panic: boom on a goroutine") || !strings.Contains(string(output), "goroutine ") {
+		t.Errorf("the trace did not make it, output: %s", output)
+	}
+}
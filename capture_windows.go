@@ -0,0 +1,34 @@
+// +build windows
+
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"os"
+)
+
+// note: on windows only os.Stdout and os.Stderr are replaced, so the output of cgo and the runtime is not captured
+
+const (
+	// the "duplicate" is the original os.Stdout (or os.Stderr) itself, it must stay open
+	closeDuplicateOutput = false
+)
+
+func duplicateOutput(fd int) (*os.File, error) {
+	if fd == fdStdout {
+		return os.Stdout, nil
+	}
+	return os.Stderr, nil
+}
+
+func redirectOutput(fd int, to *os.File) error {
+	if fd == fdStdout {
+		os.Stdout = to
+	} else {
+		os.Stderr = to
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// muxrun starts a program and forwards its stdout and stderr to the receiver over the mux:
+//
+//	muxrun [-port 7777] -- ./script.sh arg1 arg2
+//
+// the exit code of the program is sent as the last frame (see base.Exit) and is also used as muxrun's own exit code
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nontechno/base"
+)
+
+var (
+	// signals received by muxrun are passed on to the child process
+	forwardedSignals = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM}
+)
+
+func main() {
+	port := flag.Int("port", 0, "port of the receiver (taken from the ports file if not specified)")
+	flush := flag.Duration("flush", 5*time.Second, "how long to wait for the remaining output to be sent on exit")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-port N] [-flush D] -- program [args...]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	if *port == 0 {
+		if ports := base.DiscoverPorts(); len(ports) > 0 {
+			*port = ports[0]
+		} else {
+			fmt.Fprintf(os.Stderr, "no receiver port specified and none found in the ports file\n")
+			os.Exit(2)
+		}
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create stdout pipe: %v\n", err)
+		os.Exit(127)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create stderr pipe: %v\n", err)
+		os.Exit(127)
+	}
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start (%s): %v\n", args[0], err)
+		os.Exit(127)
+	}
+
+	// the fingerprint is assembled on connect, so these need to be set before the mux writer is created
+	base.SetFingerprintFact("child.cmdline", strings.Join(args, " "))
+	base.SetFingerprintFact("child.pid", cmd.Process.Pid)
+
+	mux := base.CreateMuxWriter(*port)
+	pipeStdout, _ := mux.NewWriter(base.Stdout)
+	pipeStderr, _ := mux.NewWriter(base.Stderr)
+
+	signals := make(chan os.Signal, len(forwardedSignals))
+	signal.Notify(signals, forwardedSignals...)
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go forward(&wg, pipeStdout, stdout)
+	go forward(&wg, pipeStderr, stderr)
+	wg.Wait() // all the reading has to be done before calling Wait
+
+	code := exitCode(cmd.Wait())
+	signal.Stop(signals)
+
+	if status, err := mux.NewWriter(base.Exit); err == nil {
+		_, _ = status.Write([]byte(strconv.Itoa(code)))
+	}
+
+	if err := mux.Flush(*flush); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to send the remaining output: %v\n", err)
+	}
+
+	os.Exit(code)
+}
+
+func forward(wg *sync.WaitGroup, to io.Writer, from io.Reader) {
+	defer wg.Done()
+	if _, err := io.Copy(to, from); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to forward output: %v\n", err)
+	}
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if code := exitErr.ExitCode(); code >= 0 {
+			return code
+		}
+		// killed by a signal, reported the way the shells do
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+	}
+	return 1
+}
@@ -0,0 +1,32 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("there is no sh to run")
+	}
+
+	tests := []struct {
+		script   string
+		expected int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + 15},
+		{"kill -KILL $$", 128 + 9},
+	}
+	for _, test := range tests {
+		if code := exitCode(exec.Command("sh", "-c", test.script).Run()); code != test.expected {
+			t.Errorf("(%s) exited with (%d), expected (%d)", test.script, code, test.expected)
+		}
+	}
+}
@@ -12,7 +12,9 @@ import (
 
 var (
 	// aliases
-	GetValue = config.GetValue
-	GetFlag  = config.GetFlag
-	sprintf  = fmt.Sprintf
+	GetValue    = config.GetValue
+	GetFlag     = config.GetFlag
+	GetInt      = config.GetInt
+	GetDuration = config.GetDuration
+	sprintf     = fmt.Sprintf
 )
@@ -0,0 +1,83 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	idCrashCounter = "base.crashes"
+)
+
+var (
+	crashGuard   sync.Mutex
+	crashCounter Counter
+)
+
+// runs the func on a new goroutine, a panic on that goroutine is reported (see RecoverAndReport)
+func Go(fn func()) {
+	go func() {
+		defer RecoverAndReport()
+		fn()
+	}()
+}
+
+// meant to be deferred; if there is a panic, it is reported over the Logger stream (as a structured event)
+// and the Stderr stream (as a trace), the crash counter is bumped and everything is sent before the panic proceeds
+//
+//	defer base.RecoverAndReport()
+func RecoverAndReport() {
+	if r := recover(); r != nil {
+		reportCrash(r, debug.Stack())
+		panic(r)
+	}
+}
+
+func reportCrash(value interface{}, stack []byte) {
+	initPipes()
+
+	GetLogger().WithFields(log.Fields{
+		"crash.value": fmt.Sprintf("%v", value),
+		"crash.type":  fmt.Sprintf("%T", value),
+		"crash.stack": string(stack),
+		"fingerprint": json.RawMessage(assembleFingerprint()),
+	}).Errorf("panic: %v", value)
+
+	if pipe := getPipe(Stderr); pipe != nil {
+		fmt.Fprintf(pipe, "panic: %v\n\n%s", value, stack)
+	}
+
+	getCrashCounter().Add(1)
+
+	if err := flushMetrics(timeoutWrite); err != success {
+		warning("failed to flush metrics: %v\n", err)
+	}
+	if err := FlushPipes(timeoutWrite); err != success {
+		warning("failed to flush pipes: %v\n", err)
+	}
+}
+
+func getCrashCounter() Counter {
+	crashGuard.Lock()
+	defer crashGuard.Unlock()
+
+	if crashCounter == nil {
+		crashCounter = CreateNewCounter(idCrashCounter, "Crashes", "count")
+	}
+	return crashCounter
+}
+
+func resetCrashCounter() {
+	crashGuard.Lock()
+	defer crashGuard.Unlock()
+
+	crashCounter = nil
+}
@@ -0,0 +1,22 @@
+// +build go1.23
+
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"os"
+	"runtime/debug"
+)
+
+const (
+	crashOutputSupported = true
+)
+
+// makes the runtime write its fatal error reports (e.g. the trace of an unrecovered panic) to the file as well,
+// nil stops it
+func setCrashOutput(to *os.File) error {
+	return debug.SetCrashOutput(to, debug.CrashOptions{})
+}
@@ -0,0 +1,21 @@
+// +build !go1.23
+
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"os"
+)
+
+const (
+	crashOutputSupported = false
+)
+
+// note: the runtime cannot be told where to write its fatal error reports before go1.23,
+// these go to fd 2 only (see CaptureOutput)
+func setCrashOutput(to *os.File) error {
+	return success
+}
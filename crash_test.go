@@ -0,0 +1,74 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base_test
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+const (
+	envGoChild = "BASE_TEST_GO_CHILD"
+)
+
+// the panic is reported and counted, then it proceeds
+func TestRecoverAndReport(t *testing.T) {
+	kit := basetest.New(t)
+
+	var recovered interface{}
+	started := time.Now()
+	func() {
+		defer func() { recovered = recover() }()
+		defer base.RecoverAndReport()
+		panic("boom")
+	}()
+
+	if recovered != "boom" {
+		t.Errorf("the panic did not proceed, recovered (%v)", recovered)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("the report took (%v), the flush must have timed out", elapsed)
+	}
+	kit.AssertMetric("base.crashes", "1")
+	kit.AssertContains(base.Stderr, "panic: boom")
+	kit.AssertContains(base.Stderr, "crash_test.go")
+	kit.AssertContains(base.Logger, `"crash.value":"boom"`)
+}
+
+// a panic on a goroutine started with Go kills the process, the report (and the counter) is sent before that
+func TestGoReportsCrash(t *testing.T) {
+	if os.Getenv(envGoChild) == "1" {
+		base.Go(func() { panic("boom on Go") })
+		time.Sleep(5 * time.Second)
+		os.Exit(0)
+	}
+
+	receiver := basetest.NewReceiver()
+	port, err := base.CreateReceiver(0, receiver.Connect)
+	if err != nil {
+		t.Fatalf("failed to create the receiver: %v", err)
+	}
+	defer base.CloseReceiver(port)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestGoReportsCrash$")
+	cmd.Env = append(os.Environ(), envGoChild+"=1", "BASE_PORTS="+strconv.Itoa(port))
+	if output, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("the child was expected to crash, output: %s", output)
+	}
+
+	// the child is gone, what it managed to send is (about to be) received
+	if !receiver.WaitFor(func() bool { return receiver.MetricReached("base.crashes", "1") }, 5*time.Second) {
+		t.Errorf("the crash was not counted, received %q", receiver.MetricValues("base.crashes"))
+	}
+	if !receiver.WaitFor(func() bool { return receiver.Contains(base.Stderr, "panic: boom on Go") }, 5*time.Second) {
+		t.Errorf("the trace was not sent")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envPorts             = "BASE_PORTS" // the ports themselves, e.g. "7777" or "[7777,7778]"
+	defaultPortsFilename = "port.json"
+	runtimeDirName       = "nontechno"
+)
+
+// returns the list of receiver ports, looked up in (the first one found wins):
+//   - BASE_PORTS env.var
+//   - the file specified by "ports.filename" config value
+//   - port.json in the well-known runtime directory (see RuntimeDir)
+//   - port.json in the working directory
+//
+// a file published by a receiver that is gone (see PublishPort) is skipped
+func DiscoverPorts() []int {
+	ports, _ := discoverPorts()
+	return ports
+}
+
+// the directory receivers publish their ports in: "ports.runtime.dir" config value,
+// or "nontechno" under $XDG_RUNTIME_DIR (or the temp directory)
+func RuntimeDir() string {
+	if dir := GetValue("ports.runtime.dir", ""); len(dir) > 0 {
+		return dir
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); len(dir) > 0 {
+		return filepath.Join(dir, runtimeDirName)
+	}
+	return filepath.Join(os.TempDir(), runtimeDirName)
+}
+
+func discoverPorts() ([]int, string) {
+	if value := strings.TrimSpace(os.Getenv(envPorts)); len(value) > 0 {
+		if ports, err := parsePorts([]byte(value)); err == success && len(ports) > 0 {
+			return ports, "$" + envPorts
+		}
+	}
+
+	for _, filename := range portsFilenames() {
+		if ports, err := loadPorts(filename); err == success && len(ports) > 0 {
+			return ports, filename
+		}
+	}
+	return nil, ""
+}
+
+func portsFilenames() []string {
+	var filenames []string
+	if filename := GetValue("ports.filename", ""); len(filename) > 0 {
+		filenames = append(filenames, filename)
+	}
+	return append(filenames, filepath.Join(RuntimeDir(), defaultPortsFilename), defaultPortsFilename)
+}
+
+func portsSources() []string {
+	return append([]string{"$" + envPorts}, portsFilenames()...)
+}
+
+// a file published by a receiver that is gone (killed, or exited without closing) is ignored,
+// the files without a lock (e.g. written by hand) are taken as they are
+func loadPorts(filename string) ([]int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if lock := filename + suffixLock; fileExists(lock) && staleLock(lock) {
+		return nil, errStalePortsFile
+	}
+	return parsePorts(data)
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// accepts a json array of ports ("[7777,7778]") as well as a comma separated list ("7777,7778")
+func parsePorts(data []byte) ([]int, error) {
+	var ports []int
+	if err := json.Unmarshal(data, &ports); err == nil {
+		return ports, success
+	}
+
+	for _, part := range strings.Split(string(data), ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return ports, success
+}
+
+// polls the discovery sources and rewires the pipes (and with them the metrics) when the receiver port changes
+func watchPorts(stop chan bool) {
+	interval := GetDuration("ports.watch.interval", 100*time.Millisecond, time.Hour, 5*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ports, source := discoverPorts()
+			if len(ports) == 0 {
+				continue // keep whatever we have, the mux keeps reconnecting
+			}
+
+			pipesGuard.Lock()
+			if pipesWatch == stop && (pipesMux == nil || pipesPort != ports[0]) {
+				GetLogger().Infof("receiver port changed to %d (from %s)", ports[0], source)
+				connectPipes(ports[0])
+			}
+			pipesGuard.Unlock()
+		}
+	}
+}
+
+// note: expects pipesGuard to be locked
+func stopWatchingPorts() {
+	if pipesWatch != nil {
+		close(pipesWatch)
+		pipesWatch = nil
+	}
+}
@@ -15,8 +15,26 @@ var (
 	errInternalUseId      = errors.New("this id is reserved for internal use")
 	errParamIsNil         = errors.New("a required parameter is nil")
 	errNotConnected       = errors.New("there is no connection...")
+	errFlushTimeout       = errors.New("timed out waiting for the data to be sent")
+	errEmptyStreamName    = errors.New("the stream name is empty")
+	errAlreadyCapturing   = errors.New("the output is already being captured")
+	errPortsFileLocked    = errors.New("the ports file is locked by another receiver")
+	errNoStatsdAddress    = errors.New("the statsd address is not configured")
+	errBadAggregation     = errors.New("the aggregation mode is not supported")
+	errBadWatchCondition  = errors.New("the watch condition is not valid")
+	errNoStateFile        = errors.New("the state file is not configured")
+	errCorruptStateFile   = errors.New("the state file is corrupt")
+	errStreamOverflow     = errors.New("the reader fell behind, some of the stream was dropped")
+	errStreamIdReserved   = errors.New("this id is allocated to a named stream")
+	errStalePortsFile     = errors.New("the receiver that published the ports file is gone")
+	errNotAMetric         = errors.New("not a metric created by this package")
 
-	errIncompleteData = errors.New("incomplete data")
+	errIncompleteData     = errors.New("incomplete data")
+	errIndexTooLarge      = errors.New("the metric index does not fit the (version 1) packet")
+	errValueTooLarge      = errors.New("the metric value is too large")
+	errUnsupportedRecord  = errors.New("the record is not supported by this version of the metrics stream")
+	errUnsupportedValue   = errors.New("the value type is not supported")
+	errUnsupportedVersion = errors.New("unsupported version of the metrics stream")
 
 	success error = nil
 )
@@ -24,14 +24,11 @@ var (
 )
 
 func GetLogger() *log.Logger {
-	if logger != nil {
-		return logger
-	}
-
+	// note: no unguarded peek at "logger" (the race detector flags it)
 	guard.Lock()
 	defer guard.Unlock()
 
-	if logger != nil { // need this in case it was created on another thread, while we were locked ...
+	if logger != nil {
 		return logger
 	}
 
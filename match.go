@@ -39,6 +39,7 @@ func MatchString(source string, pattern string) (bool, []string) {
 				after := src[index+len(fragment):]
 
 				src = after
+				allowPrefix = true // the next fragment comes after a star
 			} else {
 				return false, nil
 			}
@@ -0,0 +1,34 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchString(t *testing.T) {
+	tests := []struct {
+		source   string
+		pattern  string
+		matched  bool
+		fillings []string
+	}{
+		{"queue.in.depth", "", true, nil},
+		{"queue.in.depth", "in", true, nil},
+		{"queue.in.depth", "queue.*", true, []string{"in.depth"}},
+		{"queue.in.depth", "*.depth", true, []string{"queue.in"}},
+		{"queue.in.depth", "queue.*.depth", true, []string{"in"}},
+		{"queue.in.depth", "*.in.*", true, []string{"queue", "depth"}},
+		{"queue.in.depth", "in.*", false, nil},
+		{"queue.in.state", "queue.*.depth", false, nil},
+	}
+	for _, test := range tests {
+		matched, fillings := MatchString(test.source, test.pattern)
+		if matched != test.matched || !reflect.DeepEqual(fillings, test.fillings) {
+			t.Errorf("(%s) against (%s): %v %q, expected %v %q", test.source, test.pattern, matched, fillings, test.matched, test.fillings)
+		}
+	}
+}
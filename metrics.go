@@ -5,9 +5,9 @@
 package base
 
 import (
-	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,59 +15,146 @@ import (
 
 const (
 	prefixOneTimeMetric = "one.time.metric:"
+	idDroppedUpdates    = "base.metrics.dropped"
+	defaultOneTimeTTL   = 5 * time.Minute
+
+	flagPublish    Index = 0x8000 // marks a (version 1) packet carrying id, name, units and value of a metric
+	maxPacketIndex Index = 0x7fff
 )
 
 type (
 	Metric interface {
 		Post(value string)
 		Update(interface{})
+		Unregister()
 	}
 
 	Counter interface {
 		Add(int64)
 		Set(int64)
+		Unregister()
 	}
 
-	Index = uint16
+	// the position of a metric in the registry (see metricsRegistry), it is what the metrics stream refers to;
+	// note: it used to be uint16 (with the top bit marking publishes), version 1 packets still take up to maxPacketIndex only
+	Index = uint32
+
+	// what kind of values a metric has
+	MetricType byte
 
 	metricClient struct {
 		id    string
 		name  string
 		units string
+		kind  MetricType
+
+		// histograms and summaries (set on creation)
+		buckets   []float64
+		quantiles []float64
+
+		// the members of a vector (see metricVec)
+		family string
+		labels []Label
+		vec    *metricVec
+
+		state       int32         // see metricRegistered etc. (atomic)
+		stale       int32         // 1 - an update was dropped, the collector is to pick up the current value (atomic)
+		ttl         time.Duration // the metric expires once it is idle this long (0 - never)
+		aggregation int32         // see Aggregation (atomic)
+
+		published bool         // guarded by metricsGuard
+		index     Index        // assigned under metricsGuard, read atomically (see currentIndex)
+		sample    atomic.Value // *metricSample, see current
+
+		counter int64  // atomic
+		gauge   uint64 // float64 bits (atomic)
+		touched int64  // the last update (unix nanoseconds, atomic), whether or not it changed the value (see expireMetrics)
+		origin  int64  // the value a counter was created with (e.g. restored, see createPersistentCounter), not an increment
+	}
 
-		published bool
-		index     Index
-		value     string
-		last      time.Time
+	// the latest value of a metric, replaced as a whole
+	metricSample struct {
+		value interface{} // see normalizeValue
+		time  time.Time
+	}
 
-		counter int64
+	// what the receiver is told to drop (see Unregister and expireMetrics)
+	metricRemoval struct {
+		id        string
+		index     Index
+		published bool
 	}
 
 	clentUpdate struct {
-		index Index
-		value string
+		index       Index
+		value       interface{}
+		time        time.Time
+		observed    bool           // the value is an observation (float64) of a histogram or a summary
+		removal     *metricRemoval // set (instead of the value) if the metric was unregistered
+		aggregation Aggregation    // of the metric, at the time of the update
+	}
+
+	clientPacket struct {
+		updates  []clentUpdate
+		removals []metricRemoval // the receiver is told about these before the updates
+		done     chan bool       // if set, closed once the packet is written
+		closed   time.Time       // when the collector closed the window (on a tick or a flush), the watchers are checked then
 	}
+
+	// gets every batch of updates the collector flushes (on the sender's goroutine), whether or not
+	// there is a metrics pipe to write them to; the removals come first (as updates with the removal set)
+	metricsListener func(updates []clentUpdate)
 )
 
 var (
-	vacantMetricSlot uint32
-	metricsGuard     sync.Mutex
-	metricsStore     []*metricClient
+	metricsGuard sync.Mutex
+	metricsStore = newMetricsRegistry()
 
 	metricsInitialized = false
+	metricsWireVersion = MetricsWireV2
+	metricsTTL         = time.Duration(0)
 	metricsPipe        = make(chan clentUpdate, 1234)
-	tobesentPipe       = make(chan []clentUpdate, 123)
+	tobesentPipe       = make(chan clientPacket, 123)
+	metricsFlushPipe   = make(chan chan bool)
+	metricsResetPipe   = make(chan chan bool)
+	metricsDropped     uint64 // the updates that did not fit metricsPipe (atomic)
+
+	// the latest (flushed) value of every metric, the receiver gets them on every (re)connect (see sendMetricsSnapshot)
+	latestGuard   sync.Mutex
+	latestUpdates = map[Index]clentUpdate{}
+
+	listenersGuard   sync.Mutex
+	metricsListeners = map[int]metricsListener{}
+	vacantListener   = 0
+)
+
+const (
+	TypeMetric    MetricType = iota // string (or any other) values, see Metric
+	TypeCounter                     // int64
+	TypeGauge                       // float64
+	TypeHistogram                   // HistogramValue
+	TypeSummary                     // SummaryValue
+)
+
+const (
+	metricRegistered   int32 = iota
+	metricExpired            // removed by the collector (see expireMetrics), brought back by the next update
+	metricUnregistered       // removed for good (see Unregister)
 )
 
 func CreateNewMetric(id, name, units string) Metric {
-	return Metric(createNewMetric(id, name, units))
+	return Metric(createNewMetric(id, name, units, TypeMetric, nil))
 }
 
 func CreateNewCounter(id, name, units string) Counter {
-	return Counter(createNewMetric(id, name, units))
+	if persistSelected(id) {
+		return Counter(createPersistentCounter(id, name, units)) // see CreatePersistentCounter
+	}
+	return Counter(createNewMetric(id, name, units, TypeCounter, nil))
 }
 
-func createNewMetric(id, name, units string) *metricClient {
+// "setup" (if any) is called on a newly created metric, before it is registered
+func createNewMetric(id, name, units string, kind MetricType, setup func(*metricClient)) *metricClient {
 	initPipes()
 
 	metricsGuard.Lock()
@@ -75,153 +162,473 @@ func createNewMetric(id, name, units string) *metricClient {
 
 	if !metricsInitialized {
 		metricsInitialized = true
+		metricsWireVersion = GetInt("metrics.wire.version", MetricsWireLegacy, MetricsWireV2, MetricsWireV2)
+		metricsTTL = GetDuration("metrics.ttl", 0, 365*24*time.Hour, 0)
 		go clientCollector()
 		go clientSender()
-	}
-
-	// let's see if we already have a metric with this 'id'
-	if metricsStore != nil {
-		for _, entry := range metricsStore {
-			if entry != nil {
-				if entry.id == id {
-					warning("a redundant metric creation, id: %s", id)
-					return entry
-				}
-			}
-		}
+		startStatsDFromConfig()
+		startRuntimeMetricsFromConfig()
 	}
 
 	sender := metricClient{
 		id:        id,
 		name:      name,
 		units:     units,
-		index:     Index(atomic.AddUint32(&vacantMetricSlot, 1)),
+		kind:      kind,
 		published: false,
+		ttl:       metricsTTL,
+	}
+	sender.store(nil, time.Now())
+	if setup != nil {
+		setup(&sender)
+	}
+
+	// let's see if we already have a metric with this 'id'
+	if entry := metricsStore.lookup(id); entry != nil {
+		if entry.kind == kind {
+			warning("a redundant metric creation, id: %s\n", id)
+			return entry
+		}
+		// the values of one kind would be lost in the fields of the other, the new one is left out
+		warning("metric (%s) already exists as a %s, the %s is not registered (its updates are ignored)\n", id, entry.kind, kind)
+		sender.state = metricUnregistered
+		return &sender
 	}
-	sender.register()
+	metricsStore.add(&sender)
+	exportExpvar(&sender)
 
 	return &sender
 }
 
+// the metric expires (see "metrics.one.time.ttl") once it is not updated for a while
 func OneTimeMetric(name string, value interface{}, units string) {
-	CreateNewMetric(prefixOneTimeMetric+name, name, units).Update(value)
+	ttl := GetDuration("metrics.one.time.ttl", 0, 365*24*time.Hour, defaultOneTimeTTL)
+	createNewMetric(prefixOneTimeMetric+name, name, units, TypeMetric, func(ms *metricClient) {
+		ms.ttl = ttl
+	}).Update(value)
 }
 
-func (cu *clentUpdate) write(media io.Writer) {
-	writePacket(media, cu.index, cu.value)
+func (ms *metricClient) Update(value interface{}) {
+	ms.post(normalizeValue(value))
+}
 
-	/*
+func (ms *metricClient) Post(value string) {
+	ms.post(value)
+}
 
-		var index [2]byte
-		index[0] = byte(cu.index >> 8)
-		index[1] = byte(cu.index & 0x00ff)
-		media.Write(index[:])
+func (ms *metricClient) Add(delta int64) {
+	value := atomic.AddInt64(&ms.counter, delta)
+	ms.post(value)
+}
 
-		data := []byte(cu.value)
-		media.Write([]byte{byte(len(data) & 0x000000ff)})
-		media.Write(data)
-	*/
+func (ms *metricClient) Set(value int64) {
+	atomic.StoreInt64(&ms.counter, value)
+	ms.post(value)
 }
 
-func (ms *metricClient) register() {
-	// metricsGuard.Lock()
+// removes the metric, the receiver is told to drop it; the updates that follow are ignored
+// (and a metric with the same id can be created again)
+func (ms *metricClient) Unregister() {
+	metricsGuard.Lock()
+	registered := metricsStore.get(ms.index) == ms
+	removal := metricRemoval{id: ms.id, index: ms.index, published: ms.published}
+	if registered {
+		metricsStore.remove(ms)
+		unexportExpvar(ms)
+	}
+	atomic.StoreInt32(&ms.state, metricUnregistered)
+	metricsGuard.Unlock()
 
-	if metricsStore == nil {
-		metricsStore = make([]*metricClient, 100)
-	} else if len(metricsStore) == cap(metricsStore) { // todo: test this
-		store := make([]*metricClient, len(metricsStore), cap(metricsStore)*2)
-		copy(store, metricsStore)
-		metricsStore = store
+	if ms.vec != nil {
+		ms.vec.forget(ms)
+	}
+	if ms.kind == TypeCounter {
+		forgetPersistentCounter(ms)
+	}
+	if registered {
+		// through the collector, so the updates posted before are dropped along with it;
+		// note: unlike the updates, it waits for room in the pipe (it must not be lost)
+		metricsPipe <- clentUpdate{index: removal.index, removal: &removal}
 	}
-	metricsStore[ms.index] = ms
-	// metricsGuard.Unlock()
 }
 
-func (ms *metricClient) Update(value interface{}) {
-	if value == nil {
-		ms.Post("null")
+// false if the metric is not registered (and cannot be brought back)
+func (ms *metricClient) alive() bool {
+	switch atomic.LoadInt32(&ms.state) {
+	case metricRegistered:
+		return true
+	case metricExpired:
+		return ms.revive()
+	default:
+		return false
+	}
+}
+
+// registers an expired metric again (under a new index)
+func (ms *metricClient) revive() bool {
+	metricsGuard.Lock()
+	defer metricsGuard.Unlock()
+
+	switch atomic.LoadInt32(&ms.state) {
+	case metricRegistered:
+		return true
+	case metricUnregistered:
+		return false
+	}
+	if metricsStore.lookup(ms.id) != nil {
+		return false // a metric with this id was created since
+	}
+	metricsStore.add(ms)
+	exportExpvar(ms)
+	ms.published = false
+	ms.store(nil, time.Now())
+	atomic.StoreInt32(&ms.state, metricRegistered)
+	return true
+}
+
+// note: it does not lock anything (unless the metric has to be revived), see sendUpdate;
+// storing the sample and sending the update are two steps, the collector sends what is stored (see catchUpLive)
+func (ms *metricClient) post(value interface{}) {
+	if !ms.alive() {
 		return
 	}
+	now := time.Now()
+	ms.touch(now) // an update of the same value keeps the metric from expiring all the same
 
-	switch actual := value.(type) {
-	case string:
-		ms.Post(actual)
-	default:
-		ms.Post(fmt.Sprintf("%v", value))
+	aggregation := Aggregation(atomic.LoadInt32(&ms.aggregation))
+	if aggregation == AggregateNone && sameValue(ms.current().value, value) {
+		return // every update counts when aggregated, otherwise only the changes do
 	}
+
+	ms.store(value, now)
+	ms.send(clentUpdate{
+		index:       ms.currentIndex(),
+		value:       value,
+		time:        now,
+		aggregation: aggregation,
+	})
 }
 
-func (ms *metricClient) Post(value string) {
-	if ms.value != value {
-		ms.value = value
-		ms.last = time.Now()
+// the latest value (and when it was set)
+func (ms *metricClient) current() *metricSample {
+	if sample, ok := ms.sample.Load().(*metricSample); ok {
+		return sample
+	}
+	return &metricSample{}
+}
+
+func (ms *metricClient) store(value interface{}, at time.Time) {
+	ms.sample.Store(&metricSample{value: value, time: at})
+	ms.touch(at)
+}
 
-		metricsPipe <- clentUpdate{
-			index: ms.index,
-			value: ms.value,
+func (ms *metricClient) touch(at time.Time) {
+	atomic.StoreInt64(&ms.touched, at.UnixNano())
+}
+
+// how long the metric was not updated for
+func (ms *metricClient) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&ms.touched)))
+}
+
+func (ms *metricClient) currentIndex() Index {
+	return atomic.LoadUint32(&ms.index)
+}
+
+// never blocks: if the collector cannot keep up, the update is dropped (and counted, see reportDrops);
+// the latest value is not lost though, the collector picks it up once it catches up (observations are lost)
+func (ms *metricClient) send(update clentUpdate) {
+	select {
+	case metricsPipe <- update:
+	default:
+		atomic.AddUint64(&metricsDropped, 1)
+		if !update.observed {
+			atomic.StoreInt32(&ms.stale, 1)
 		}
 	}
 }
 
-func (ms *metricClient) Add(delta int64) {
-	value := atomic.AddInt64(&ms.counter, delta)
-	ms.Post(fmt.Sprintf("%v", value))
+// the number of metric updates dropped (since the start) because the collector could not keep up
+func DroppedMetricUpdates() uint64 {
+	return atomic.LoadUint64(&metricsDropped)
 }
 
-func (ms *metricClient) Set(value int64) {
-	atomic.StoreInt64(&ms.counter, value)
-	ms.Post(fmt.Sprintf("%v", value))
+// returns the current values of the metrics whose updates were dropped (since the last report)
+// and the updated "base.metrics.dropped" counter
+// note: called on the collector's goroutine
+func reportDrops(reported uint64) (uint64, []clentUpdate) {
+	dropped := atomic.LoadUint64(&metricsDropped)
+	if dropped <= reported {
+		return dropped, nil
+	}
+	warning("dropped %d metric updates (the collector cannot keep up)\n", dropped-reported)
+
+	var updates []clentUpdate
+	metricsGuard.Lock()
+	metricsStore.each(func(ms *metricClient) {
+		if atomic.CompareAndSwapInt32(&ms.stale, 1, 0) {
+			sample := ms.current()
+			updates = append(updates, clentUpdate{
+				index:       ms.index,
+				value:       sample.value,
+				time:        sample.time,
+				aggregation: Aggregation(atomic.LoadInt32(&ms.aggregation)),
+			})
+		}
+	})
+	counter := metricsStore.lookup(idDroppedUpdates)
+	metricsGuard.Unlock()
+
+	if counter == nil {
+		counter = createNewMetric(idDroppedUpdates, "Dropped metric updates", "count", TypeCounter, nil)
+	}
+	now := time.Now()
+	atomic.StoreInt64(&counter.counter, int64(dropped))
+	counter.store(int64(dropped), now)
+	updates = append(updates, clentUpdate{index: counter.currentIndex(), value: int64(dropped), time: now})
+
+	return dropped, updates
 }
 
-func (ms *metricClient) publish(media io.Writer) {
-	const separator = "\000"
-	value := ms.id + separator + ms.name + separator + ms.units + separator + ms.value + separator + separator
-	writePacket(media, ms.index|0x8000, value)
+// the values that can be compared (the rest are never the same)
+func sameValue(a, b interface{}) bool {
+	switch a.(type) {
+	case nil, string, int64, float64:
+		return a == b
+	}
+	return false
 }
 
 func clientCollector() {
 
-	updates := map[Index]string{}
-	ticker := time.NewTicker(1000 * time.Millisecond)
+	updates := map[Index]clentUpdate{}
+	observed := map[Index]*observations{} // histograms and summaries (cumulative)
+	windows := map[Index]*window{}        // the aggregated metrics (see SetAggregation)
+	started := time.Now()                 // the current window
+	ticker := time.NewTicker(flushInterval())
 	defer ticker.Stop()
 
+	dropped := uint64(0) // reported so far
+
+	removals := []metricRemoval{}
+	drop := func(removal metricRemoval) {
+		delete(updates, removal.index)
+		delete(observed, removal.index)
+		delete(windows, removal.index)
+		removals = append(removals, removal)
+	}
+
+	collect := func(update clentUpdate) {
+		if update.removal != nil {
+			drop(*update.removal)
+		} else if update.observed {
+			observe(observed, update)
+		} else if update.aggregation == AggregateNone || !aggregate(windows, update) {
+			delete(windows, update.index) // no longer aggregated (or not a number)
+			updates[update.index] = update
+		}
+	}
+
+	catchUp := func() {
+		var stale []clentUpdate
+		dropped, stale = reportDrops(dropped)
+		for _, update := range stale {
+			collect(update)
+		}
+	}
+
+	closeWindow := func(now time.Time) {
+		summarize(observed, updates)
+		closeWindows(windows, updates, started, now)
+		catchUpLive(updates)
+		started = now
+	}
+
 	for {
 		select {
 		case update := <-metricsPipe:
-			updates[update.index] = update.value
+			collect(update)
 
-		case <-ticker.C:
+		case done := <-metricsFlushPipe:
+			// take in what was posted before the flush was requested
+			for len(metricsPipe) > 0 {
+				collect(<-metricsPipe)
+			}
+			catchUp()
+			now := time.Now()
+			closeWindow(now)
+			tobesentPipe <- clientPacket{updates: collected(updates), removals: removals, done: done, closed: now}
+			updates = map[Index]clentUpdate{}
+			removals = []metricRemoval{}
+
+		case now := <-ticker.C:
 			// fmt.Println("Tick at", t)
-			if len(updates) > 0 {
-				packet := make([]clentUpdate, 0, len(updates))
-				for index, value := range updates {
-					packet = append(packet, clentUpdate{index: index, value: value})
-				}
-				updates = map[Index]string{}
-				tobesentPipe <- packet
+			for _, removal := range expireMetrics(now) {
+				drop(removal)
+			}
+			catchUp()
+			closeWindow(now)
+			// sent even if empty, the watchers are checked on every tick (see checkWatchers)
+			tobesentPipe <- clientPacket{updates: collected(updates), removals: removals, closed: now}
+			updates = map[Index]clentUpdate{}
+			removals = []metricRemoval{}
+
+		case done := <-metricsResetPipe:
+			// what was collected before the reset is dropped (the indexes are about to be reused)
+			for len(metricsPipe) > 0 {
+				<-metricsPipe
 			}
+			updates = map[Index]clentUpdate{}
+			observed = map[Index]*observations{}
+			windows = map[Index]*window{}
+			removals = []metricRemoval{}
+			dropped = 0
+			started = time.Now()
+			ticker.Reset(flushInterval())
+			// the sender closes it once it is done with the packets sent before
+			tobesentPipe <- clientPacket{done: done}
 		}
 	}
 }
 
-func publishNamesAndUnits(media io.Writer, force bool) {
+// the updates of concurrent changes may come in out of order (e.g. 2 and then 1, or two posts of a metric),
+// so the value sent is the one the metric holds as the window closes: the latest of a counter or a gauge,
+// the stored sample of the rest (the one the next post is compared with, see post)
+// note: called on the collector's goroutine
+func catchUpLive(updates map[Index]clentUpdate) {
 	metricsGuard.Lock()
 	defer metricsGuard.Unlock()
 
-	for _, metric := range metricsStore {
-		if metric != nil && (metric.published == false || force) {
-			metric.published = true
-			metric.publish(media)
+	for index, update := range updates {
+		ms := metricsStore.get(index)
+		if ms == nil {
+			continue
 		}
+		if _, aggregated := update.value.(WindowValue); aggregated {
+			continue // see closeWindows
+		}
+		if value := ms.liveValue(); value != nil {
+			update.value = value
+			updates[index] = update
+		}
+	}
+}
+
+func collected(updates map[Index]clentUpdate) []clentUpdate {
+	packet := make([]clentUpdate, 0, len(updates))
+	for _, update := range updates {
+		packet = append(packet, update)
+	}
+	return packet
+}
+
+// removes the metrics that were idle (not updated, see touch) for longer than their ttl
+// note: called on the collector's goroutine
+func expireMetrics(now time.Time) []metricRemoval {
+	metricsGuard.Lock()
+	defer metricsGuard.Unlock()
+
+	var expired []*metricClient
+	metricsStore.each(func(ms *metricClient) {
+		if ms.ttl > 0 && ms.idle(now) > ms.ttl {
+			expired = append(expired, ms)
+		}
+	})
+
+	removals := make([]metricRemoval, 0, len(expired))
+	for _, ms := range expired {
+		removals = append(removals, metricRemoval{id: ms.id, index: ms.index, published: ms.published})
+		metricsStore.remove(ms)
+		unexportExpvar(ms)
+		atomic.StoreInt32(&ms.state, metricExpired)
+	}
+	return removals
+}
+
+// writes the remove records (of the metrics the receiver knows about)
+func writeRemovals(media *metricsFrame, removals []metricRemoval) {
+	if media.version == MetricsWireLegacy {
+		return // version 1 has no way to say it
+	}
+
+	for _, removal := range removals {
+		if removal.published {
+			if err := media.remove(removal.index); err != success {
+				warning("failed to encode metric removal (%s): %v\n", removal.id, err)
+			}
+		}
+	}
+}
+
+// the indexes of the removed metrics can be reused once the receiver was told (or could not be told)
+func releaseRemovals(removals []metricRemoval) {
+	metricsGuard.Lock()
+	defer metricsGuard.Unlock()
+
+	for _, removal := range removals {
+		metricsStore.release(removal.index)
 	}
 }
 
-func sendStaticMetricInfo() error {
-	if pipeMetrics != nil {
-		media := bytes.Buffer{}
-		publishNamesAndUnits(&media, true)
+// sends the pending metric updates right away (instead of waiting for the next tick),
+// waits (up to the specified timeout) till they are written to the metrics pipe
+func flushMetrics(timeout time.Duration) error {
+	return requestCollector(metricsFlushPipe, timeout)
+}
+
+// hands the request to the collector and waits (up to the specified timeout) till the sender is done with it
+func requestCollector(requests chan chan bool, timeout time.Duration) error {
+	metricsGuard.Lock()
+	initialized := metricsInitialized
+	metricsGuard.Unlock()
+
+	if !initialized {
+		return success
+	}
+
+	done := make(chan bool)
+	deadline := time.After(timeout)
+	select {
+	case requests <- done:
+	case <-deadline:
+		return errFlushTimeout
+	}
+
+	select {
+	case <-done:
+		return success
+	case <-deadline:
+		return errFlushTimeout
+	}
+}
+
+func publishNamesAndUnits(media *metricsFrame, force bool) {
+	metricsGuard.Lock()
+	defer metricsGuard.Unlock()
+
+	metricsStore.each(func(metric *metricClient) {
+		if metric.published == false || force {
+			metric.published = true
+			if err := media.publish(metric); err != success {
+				warning("failed to publish metric (%s): %v\n", metric.id, err)
+			}
+		}
+	})
+}
 
-		if media.Len() > 0 {
+// sends the names, units and the latest values of all the metrics: on every (re)connect and,
+// if "metrics.resync.interval" is set, periodically
+func sendMetricsSnapshot() error {
+	if pipeMetrics := getPipe(Metrics); pipeMetrics != nil {
+		media := newMetricsFrame(metricsWireVersion)
+		publishNamesAndUnits(media, true)
+		for _, update := range latest() {
+			if err := media.update(update); err != success {
+				warning("failed to encode metric update (index: %d): %v\n", update.index, err)
+			}
+		}
+
+		if !media.empty() {
 			if _, err := media.WriteTo(pipeMetrics); err != nil {
 				return err
 			}
@@ -230,25 +637,91 @@ func sendStaticMetricInfo() error {
 	return success
 }
 
+// keeps the latest values (whether or not they are written anywhere)
+func rememberLatest(packet clientPacket) {
+	latestGuard.Lock()
+	defer latestGuard.Unlock()
+
+	for _, removal := range packet.removals {
+		delete(latestUpdates, removal.index)
+	}
+	for _, update := range packet.updates {
+		latestUpdates[update.index] = update
+	}
+}
+
+// the latest values, in the order of indexes
+func latest() []clentUpdate {
+	latestGuard.Lock()
+	updates := collected(latestUpdates)
+	latestGuard.Unlock()
+
+	sort.Slice(updates, func(i, j int) bool { return updates[i].index < updates[j].index })
+	return updates
+}
+
+func resetMetrics() {
+	// the metrics created so far are done with: their updates would go under the indexes of the new ones
+	metricsGuard.Lock()
+	metricsStore.each(func(ms *metricClient) {
+		atomic.StoreInt32(&ms.state, metricUnregistered)
+	})
+	metricsGuard.Unlock()
+
+	// the collector (and the sender) drop what they have in flight
+	if err := requestCollector(metricsResetPipe, timeoutWrite); err != success {
+		warning("failed to reset the metrics collector: %v\n", err)
+	}
+
+	latestGuard.Lock()
+	latestUpdates = map[Index]clentUpdate{}
+	latestGuard.Unlock()
+
+	metricsGuard.Lock()
+	defer metricsGuard.Unlock()
+
+	metricsStore = newMetricsRegistry()
+	promCollisions = map[string]bool{}
+	resetExpvar()
+	atomic.StoreUint64(&metricsDropped, 0)
+
+	for len(metricsPipe) > 0 {
+		<-metricsPipe
+	}
+}
+
 func clientSender() {
 
-	firstRun := true
+	var resync <-chan time.Time // stays nil (never fires) unless enabled
+	if interval := GetDuration("metrics.resync.interval", 0, 24*time.Hour, 0); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
 	for {
 		select {
+		case <-resync:
+			if err := sendMetricsSnapshot(); err != success {
+				warning("failed to send metrics snapshot: %v\n", err)
+			}
+
 		case packet := <-tobesentPipe: // this one is sent on timer...
-			if len(packet) > 0 {
-				if pipeMetrics != nil {
-
-					media := bytes.Buffer{}
-					// publish names-n-units
-					if firstRun {
-						firstRun = false
-						publishNamesAndUnits(&media, false)
-					}
+			if len(packet.updates) > 0 || len(packet.removals) > 0 {
+				rememberLatest(packet)
+				if pipeMetrics := getPipe(Metrics); pipeMetrics != nil {
+
+					media := newMetricsFrame(metricsWireVersion)
+					// removals first, the receiver drops them before it gets to the rest
+					writeRemovals(media, packet.removals)
+					// publish names-n-units (of the metrics created since the last time)
+					publishNamesAndUnits(media, false)
 
 					// marshal
-					for _, v := range packet {
-						v.write(&media)
+					for _, v := range packet.updates {
+						if err := media.update(v); err != success {
+							warning("failed to encode metric update (index: %d): %v\n", v.index, err)
+						}
 					}
 
 					if _, err := media.WriteTo(pipeMetrics); err != nil {
@@ -257,15 +730,62 @@ func clientSender() {
 
 					// send
 				} else {
-					// drop it on the floor ...
-					// an alternative would be to collect received data (in a map) and send it upon new connection ...
+					// nothing to write to, the latest values are sent once there is (see sendMetricsSnapshot)
 					_ = packet
 				}
+				releaseRemovals(packet.removals)
+				notifyMetricsListeners(packet)
+			}
+			if !packet.closed.IsZero() {
+				checkWatchers(packet.updates, packet.closed)
 			}
+			if packet.done != nil {
+				close(packet.done)
+			}
+		}
+	}
+}
+
+// returns the func that removes the listener
+func addMetricsListener(listener metricsListener) func() {
+	listenersGuard.Lock()
+	defer listenersGuard.Unlock()
+
+	vacantListener++
+	id := vacantListener
+	metricsListeners[id] = listener
+
+	return func() {
+		listenersGuard.Lock()
+		defer listenersGuard.Unlock()
+
+		delete(metricsListeners, id)
+	}
+}
+
+func notifyMetricsListeners(packet clientPacket) {
+	updates := packet.updates
+	if len(packet.removals) > 0 {
+		updates = make([]clentUpdate, 0, len(packet.removals)+len(packet.updates))
+		for i := range packet.removals {
+			updates = append(updates, clentUpdate{index: packet.removals[i].index, removal: &packet.removals[i]})
 		}
+		updates = append(updates, packet.updates...)
+	}
+
+	listenersGuard.Lock()
+	listeners := make([]metricsListener, 0, len(metricsListeners))
+	for _, listener := range metricsListeners {
+		listeners = append(listeners, listener)
+	}
+	listenersGuard.Unlock()
+
+	for _, listener := range listeners {
+		listener(updates)
 	}
 }
 
+// writes a version 1 packet (see metricsCodec.go)
 func writePacket(media io.Writer, index Index, value string) {
 	var buff [2]byte
 	buff[0] = byte(index >> 8)
@@ -275,8 +795,8 @@ func writePacket(media io.Writer, index Index, value string) {
 	}
 
 	data := []byte(value)
-	if len(data) > 255 {
-		// todo: error handling
+	if len(data) > maxLegacyValueSize {
+		// todo: error handling (metricsFrame checks this before getting here)
 	}
 
 	media.Write([]byte{byte(len(data) & 0x000000ff)})
@@ -0,0 +1,624 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+/*
+	the metrics stream is a sequence of frames (one frame per packet of the Metrics stream).
+
+	version 1 (legacy) frame is a sequence of packets:
+		index (2 bytes, big endian; the top bit marks "publish") | length (1 byte) | value
+		the value of a "publish" packet is: id \0 name \0 units \0 value \0 \0
+
+	version 2 frame:
+		frame   := magic (0xfe) | version (0x02) | record*
+		record  := type (1 byte) | length (uvarint) | body     - the length allows skipping unknown records
+		publish := index (uvarint) | field* | 0x00             field := tag (1 byte) | length (uvarint) | bytes
+		                                                       (id, name, units, type, family, labels)
+		update  := index (uvarint) | time (varint, unix nanoseconds, 0 - unknown) | value
+		remove  := index (uvarint)
+		value   := type (1 byte) | payload                     null: -, string: length (uvarint) | bytes,
+		                                                       int: varint, float: 8 bytes (little endian),
+		                                                       histogram: count (uvarint) | sum (float) | n (uvarint) | (bound (float) | count (uvarint))*n
+		                                                       summary: count (uvarint) | sum (float) | n (uvarint) | (quantile (float) | value (float))*n
+		                                                       window: mode (1 byte) | value (float) | count (uvarint) | min (float) | max (float) |
+		                                                               sum (float) | start (varint) | end (varint)
+
+	a version 1 frame starting with 0xfe would need an index above 0x7e00 - which version 1 never had in practice
+*/
+
+const (
+	MetricsWireLegacy = 1
+	MetricsWireV2     = 2
+
+	metricsMagic = 0xfe
+
+	maxMetricFieldSize = 1 << 20
+	maxLegacyValueSize = 255
+)
+
+type RecordKind byte
+
+const (
+	RecordPublish RecordKind = 1 + iota
+	RecordUpdate
+	RecordRemove
+)
+
+const (
+	fieldEnd byte = iota
+	fieldID
+	fieldName
+	fieldUnits
+	fieldType   // 1 byte, see MetricType
+	fieldFamily // the id of the vector the metric belongs to
+	fieldLabels // n (uvarint) | (name (string) | value (string))*n
+)
+
+const (
+	valueNull byte = iota
+	valueString
+	valueInt
+	valueFloat
+	valueHistogram
+	valueSummary
+	valueWindow
+)
+
+type (
+	// a decoded record of the metrics stream
+	MetricRecord struct {
+		Kind  RecordKind
+		Index Index
+
+		// publish
+		ID     string
+		Name   string
+		Units  string
+		Type   MetricType
+		Family string  // the id of the vector (if the metric is a member of one)
+		Labels []Label // the label set (of a vector member)
+
+		// update: string, int64, float64, HistogramValue, SummaryValue, WindowValue or nil
+		Value interface{}
+		Time  time.Time // zero if unknown (version 1)
+	}
+
+	// builds one frame of the metrics stream
+	metricsFrame struct {
+		version int
+		buffer  bytes.Buffer
+		records int
+	}
+)
+
+func newMetricsFrame(version int) *metricsFrame {
+	frame := &metricsFrame{version: version}
+	if version >= MetricsWireV2 {
+		frame.buffer.Write([]byte{metricsMagic, byte(version)})
+	}
+	return frame
+}
+
+func (frame *metricsFrame) publish(ms *metricClient) error {
+	if frame.version == MetricsWireLegacy {
+		if ms.index > maxPacketIndex {
+			return errIndexTooLarge
+		}
+		const separator = "\000"
+		value := ms.id + separator + ms.name + separator + ms.units + separator + formatValue(ms.current().value) + separator + separator
+		return frame.legacy(ms.index|flagPublish, value)
+	}
+
+	var body bytes.Buffer
+	putUvarint(&body, uint64(ms.index))
+	for _, field := range []struct {
+		tag   byte
+		value string
+	}{{fieldID, ms.id}, {fieldName, ms.name}, {fieldUnits, ms.units}} {
+		if len(field.value) > maxMetricFieldSize {
+			return errValueTooLarge
+		}
+		body.WriteByte(field.tag)
+		putString(&body, field.value)
+	}
+	body.WriteByte(fieldType)
+	putString(&body, string([]byte{byte(ms.kind)}))
+	if len(ms.family) > 0 {
+		body.WriteByte(fieldFamily)
+		putString(&body, ms.family)
+
+		var labels bytes.Buffer
+		putUvarint(&labels, uint64(len(ms.labels)))
+		for _, label := range ms.labels {
+			putString(&labels, label.Name)
+			putString(&labels, label.Value)
+		}
+		body.WriteByte(fieldLabels)
+		putString(&body, labels.String())
+	}
+	body.WriteByte(fieldEnd)
+
+	// note: unlike version 1, the value is not a part of it (see sendMetricsSnapshot)
+	return frame.record(RecordPublish, body.Bytes())
+}
+
+func (frame *metricsFrame) update(update clentUpdate) error {
+	if frame.version == MetricsWireLegacy {
+		if update.index > maxPacketIndex {
+			return errIndexTooLarge
+		}
+		return frame.legacy(update.index, formatValue(update.value))
+	}
+
+	var body bytes.Buffer
+	putUvarint(&body, uint64(update.index))
+	var timestamp int64
+	if !update.time.IsZero() {
+		timestamp = update.time.UnixNano()
+	}
+	putVarint(&body, timestamp)
+	if err := putValue(&body, update.value); err != success {
+		return err
+	}
+	return frame.record(RecordUpdate, body.Bytes())
+}
+
+func (frame *metricsFrame) remove(index Index) error {
+	if frame.version == MetricsWireLegacy {
+		return errUnsupportedRecord
+	}
+
+	var body bytes.Buffer
+	putUvarint(&body, uint64(index))
+	return frame.record(RecordRemove, body.Bytes())
+}
+
+func (frame *metricsFrame) empty() bool {
+	return frame.records == 0
+}
+
+func (frame *metricsFrame) WriteTo(media io.Writer) (int64, error) {
+	return frame.buffer.WriteTo(media)
+}
+
+func (frame *metricsFrame) record(kind RecordKind, body []byte) error {
+	frame.buffer.WriteByte(byte(kind))
+	putUvarint(&frame.buffer, uint64(len(body)))
+	frame.buffer.Write(body)
+	frame.records++
+	return success
+}
+
+func (frame *metricsFrame) legacy(index Index, value string) error {
+	if len(value) > maxLegacyValueSize {
+		return errValueTooLarge
+	}
+	writePacket(&frame.buffer, index, value)
+	frame.records++
+	return success
+}
+
+// decodes one frame of the metrics stream (either version)
+func DecodeMetricRecords(frame []byte) ([]MetricRecord, error) {
+	if len(frame) >= 2 && frame[0] == metricsMagic {
+		if frame[1] != MetricsWireV2 {
+			return nil, errUnsupportedVersion
+		}
+		return decodeRecords(frame[2:])
+	}
+	return decodeLegacyRecords(frame)
+}
+
+func decodeRecords(data []byte) ([]MetricRecord, error) {
+	var records []MetricRecord
+	for len(data) > 0 {
+		kind := RecordKind(data[0])
+		size, n := binary.Uvarint(data[1:])
+		if n <= 0 || uint64(len(data)-1-n) < size {
+			return records, errIncompleteData
+		}
+		body := data[1+n : 1+n+int(size)]
+		data = data[1+n+int(size):]
+
+		record, known, err := decodeRecord(kind, body)
+		if err != success {
+			return records, err
+		}
+		if known {
+			records = append(records, record)
+		}
+	}
+	return records, success
+}
+
+func decodeRecord(kind RecordKind, body []byte) (MetricRecord, bool, error) {
+	record := MetricRecord{Kind: kind}
+
+	index, n := binary.Uvarint(body)
+	if n <= 0 {
+		return record, false, errIncompleteData
+	}
+	record.Index = Index(index)
+	body = body[n:]
+
+	switch kind {
+	case RecordPublish:
+		for {
+			if len(body) == 0 {
+				return record, false, errIncompleteData
+			}
+			tag := body[0]
+			if tag == fieldEnd {
+				return record, true, success
+			}
+			value, rest, err := getString(body[1:])
+			if err != success {
+				return record, false, err
+			}
+			body = rest
+
+			switch tag {
+			case fieldID:
+				record.ID = value
+			case fieldName:
+				record.Name = value
+			case fieldUnits:
+				record.Units = value
+			case fieldType:
+				if len(value) > 0 {
+					record.Type = MetricType(value[0])
+				}
+			case fieldFamily:
+				record.Family = value
+			case fieldLabels:
+				labels, err := getLabels([]byte(value))
+				if err != success {
+					return record, false, err
+				}
+				record.Labels = labels
+			default:
+				// a field from a later revision - skip it
+			}
+		}
+
+	case RecordUpdate:
+		timestamp, n := binary.Varint(body)
+		if n <= 0 {
+			return record, false, errIncompleteData
+		}
+		if timestamp != 0 {
+			record.Time = time.Unix(0, timestamp)
+		}
+		value, known, err := getValue(body[n:])
+		record.Value = value
+		return record, known, err
+
+	case RecordRemove:
+		return record, true, success
+	}
+
+	// a record type from a later revision - skip it
+	return record, false, success
+}
+
+func decodeLegacyRecords(data []byte) ([]MetricRecord, error) {
+	var records []MetricRecord
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return records, errIncompleteData
+		}
+		index := Index(data[0])<<8 | Index(data[1])
+		size := int(data[2])
+		if len(data) < 3+size {
+			return records, errIncompleteData
+		}
+		value := string(data[3 : 3+size])
+		data = data[3+size:]
+
+		if index&flagPublish == 0 {
+			records = append(records, MetricRecord{Kind: RecordUpdate, Index: index, Value: value})
+			continue
+		}
+
+		// id, name, units, value
+		index &^= flagPublish
+		fields := bytes.Split([]byte(value), []byte{0})
+		if len(fields) < 4 {
+			return records, errIncompleteData
+		}
+		records = append(records, MetricRecord{
+			Kind:  RecordPublish,
+			Index: index,
+			ID:    string(fields[0]),
+			Name:  string(fields[1]),
+			Units: string(fields[2]),
+		})
+		if len(fields[3]) > 0 {
+			records = append(records, MetricRecord{Kind: RecordUpdate, Index: index, Value: string(fields[3])})
+		}
+	}
+	return records, success
+}
+
+// brings the supported values to one of: nil, string, int64, float64 (or HistogramValue, SummaryValue, WindowValue)
+func normalizeValue(value interface{}) interface{} {
+	switch actual := value.(type) {
+	case nil, string, int64, float64, HistogramValue, SummaryValue, WindowValue:
+		return actual
+	case int:
+		return int64(actual)
+	case int8:
+		return int64(actual)
+	case int16:
+		return int64(actual)
+	case int32:
+		return int64(actual)
+	case uint8:
+		return int64(actual)
+	case uint16:
+		return int64(actual)
+	case uint32:
+		return int64(actual)
+	case float32:
+		return float64(actual)
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+// the textual form of a value (as it was sent in version 1)
+func formatValue(value interface{}) string {
+	switch actual := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return actual
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+func putValue(media *bytes.Buffer, value interface{}) error {
+	switch actual := value.(type) {
+	case nil:
+		media.WriteByte(valueNull)
+	case string:
+		if len(actual) > maxMetricFieldSize {
+			return errValueTooLarge
+		}
+		media.WriteByte(valueString)
+		putString(media, actual)
+	case int64:
+		media.WriteByte(valueInt)
+		putVarint(media, actual)
+	case float64:
+		media.WriteByte(valueFloat)
+		putFloat(media, actual)
+	case HistogramValue:
+		media.WriteByte(valueHistogram)
+		putUvarint(media, actual.Count)
+		putFloat(media, actual.Sum)
+		putUvarint(media, uint64(len(actual.Buckets)))
+		for _, bucket := range actual.Buckets {
+			putFloat(media, bucket.UpperBound)
+			putUvarint(media, bucket.Count)
+		}
+	case WindowValue:
+		media.WriteByte(valueWindow)
+		media.WriteByte(byte(actual.Mode))
+		putFloat(media, actual.Value)
+		putUvarint(media, actual.Count)
+		putFloat(media, actual.Min)
+		putFloat(media, actual.Max)
+		putFloat(media, actual.Sum)
+		putVarint(media, actual.Start.UnixNano())
+		putVarint(media, actual.End.UnixNano())
+	case SummaryValue:
+		media.WriteByte(valueSummary)
+		putUvarint(media, actual.Count)
+		putFloat(media, actual.Sum)
+		putUvarint(media, uint64(len(actual.Quantiles)))
+		for _, q := range actual.Quantiles {
+			putFloat(media, q.Quantile)
+			putFloat(media, q.Value)
+		}
+	default:
+		return errUnsupportedValue
+	}
+	return success
+}
+
+func getValue(data []byte) (interface{}, bool, error) {
+	if len(data) == 0 {
+		return nil, false, errIncompleteData
+	}
+
+	switch data[0] {
+	case valueNull:
+		return nil, true, success
+	case valueString:
+		value, _, err := getString(data[1:])
+		return value, err == success, err
+	case valueInt:
+		value, n := binary.Varint(data[1:])
+		if n <= 0 {
+			return nil, false, errIncompleteData
+		}
+		return value, true, success
+	case valueFloat:
+		value, _, err := getFloat(data[1:])
+		return value, err == success, err
+	case valueHistogram:
+		var value HistogramValue
+		var count uint64
+		var err error
+		data = data[1:]
+		if value.Count, data, err = getUvarint(data); err != success {
+			return nil, false, err
+		}
+		if value.Sum, data, err = getFloat(data); err != success {
+			return nil, false, err
+		}
+		if count, data, err = getUvarint(data); err != success {
+			return nil, false, err
+		}
+		for i := uint64(0); i < count; i++ {
+			var bucket Bucket
+			if bucket.UpperBound, data, err = getFloat(data); err != success {
+				return nil, false, err
+			}
+			if bucket.Count, data, err = getUvarint(data); err != success {
+				return nil, false, err
+			}
+			value.Buckets = append(value.Buckets, bucket)
+		}
+		return value, true, success
+	case valueSummary:
+		var value SummaryValue
+		var count uint64
+		var err error
+		data = data[1:]
+		if value.Count, data, err = getUvarint(data); err != success {
+			return nil, false, err
+		}
+		if value.Sum, data, err = getFloat(data); err != success {
+			return nil, false, err
+		}
+		if count, data, err = getUvarint(data); err != success {
+			return nil, false, err
+		}
+		for i := uint64(0); i < count; i++ {
+			var q Quantile
+			if q.Quantile, data, err = getFloat(data); err != success {
+				return nil, false, err
+			}
+			if q.Value, data, err = getFloat(data); err != success {
+				return nil, false, err
+			}
+			value.Quantiles = append(value.Quantiles, q)
+		}
+		return value, true, success
+	case valueWindow:
+		var value WindowValue
+		var start, end int64
+		var err error
+		if len(data) < 2 {
+			return nil, false, errIncompleteData
+		}
+		value.Mode = Aggregation(data[1])
+		data = data[2:]
+		if value.Value, data, err = getFloat(data); err != success {
+			return nil, false, err
+		}
+		if value.Count, data, err = getUvarint(data); err != success {
+			return nil, false, err
+		}
+		if value.Min, data, err = getFloat(data); err != success {
+			return nil, false, err
+		}
+		if value.Max, data, err = getFloat(data); err != success {
+			return nil, false, err
+		}
+		if value.Sum, data, err = getFloat(data); err != success {
+			return nil, false, err
+		}
+		if start, data, err = getVarint(data); err != success {
+			return nil, false, err
+		}
+		if end, _, err = getVarint(data); err != success {
+			return nil, false, err
+		}
+		value.Start, value.End = time.Unix(0, start), time.Unix(0, end)
+		return value, true, success
+	}
+
+	// a value type from a later revision
+	return nil, false, success
+}
+
+func putUvarint(media *bytes.Buffer, value uint64) {
+	var buff [binary.MaxVarintLen64]byte
+	media.Write(buff[:binary.PutUvarint(buff[:], value)])
+}
+
+func putVarint(media *bytes.Buffer, value int64) {
+	var buff [binary.MaxVarintLen64]byte
+	media.Write(buff[:binary.PutVarint(buff[:], value)])
+}
+
+func getLabels(data []byte) ([]Label, error) {
+	count, data, err := getUvarint(data)
+	if err != success {
+		return nil, err
+	}
+
+	if count > uint64(len(data)/2) {
+		return nil, errIncompleteData // every label takes 2 bytes at least (the lengths of its name and value)
+	}
+
+	labels := make([]Label, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var label Label
+		if label.Name, data, err = getString(data); err != success {
+			return nil, err
+		}
+		if label.Value, data, err = getString(data); err != success {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+	return labels, success
+}
+
+func getUvarint(data []byte) (uint64, []byte, error) {
+	value, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, errIncompleteData
+	}
+	return value, data[n:], success
+}
+
+func getVarint(data []byte) (int64, []byte, error) {
+	value, n := binary.Varint(data)
+	if n <= 0 {
+		return 0, nil, errIncompleteData
+	}
+	return value, data[n:], success
+}
+
+func putFloat(media *bytes.Buffer, value float64) {
+	var buff [8]byte
+	binary.LittleEndian.PutUint64(buff[:], math.Float64bits(value))
+	media.Write(buff[:])
+}
+
+func getFloat(data []byte) (float64, []byte, error) {
+	if len(data) < 8 {
+		return 0, nil, errIncompleteData
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(data[:8])), data[8:], success
+}
+
+func putString(media *bytes.Buffer, value string) {
+	putUvarint(media, uint64(len(value)))
+	media.WriteString(value)
+}
+
+func getString(data []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return "", nil, errIncompleteData
+	}
+	return string(data[n : n+int(size)]), data[n+int(size):], success
+}
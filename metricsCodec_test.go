@@ -0,0 +1,191 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a publish record of a vector member whose label count is out of any range
+func TestDecodeHugeLabelCount(t *testing.T) {
+	var labels bytes.Buffer
+	putUvarint(&labels, 1<<62)
+	putString(&labels, "name")
+	putString(&labels, "value")
+
+	var body bytes.Buffer
+	putUvarint(&body, 1)
+	body.WriteByte(fieldID)
+	putString(&body, "vec")
+	body.WriteByte(fieldLabels)
+	putString(&body, labels.String())
+	body.WriteByte(fieldEnd)
+
+	frame := newMetricsFrame(MetricsWireV2)
+	frame.record(RecordPublish, body.Bytes())
+
+	if _, err := DecodeMetricRecords(frame.buffer.Bytes()); err != errIncompleteData {
+		t.Errorf("expected (%v), got (%v)", errIncompleteData, err)
+	}
+}
+
+// every prefix of a valid frame is either decoded or rejected, never a panic
+func TestDecodeTruncatedFrames(t *testing.T) {
+	member := &metricClient{id: "requests{code=200}", name: "Requests", units: "count", kind: TypeCounter, index: 3,
+		family: "requests", labels: []Label{{Name: "code", Value: "200"}}}
+	member.store(int64(1), time.Now())
+
+	frame := newMetricsFrame(MetricsWireV2)
+	frame.publish(member)
+	frame.update(clentUpdate{index: 3, value: int64(42), time: time.Now()})
+	frame.update(clentUpdate{index: 4, value: HistogramValue{Count: 2, Sum: 3, Buckets: []Bucket{{UpperBound: 1, Count: 1}, {UpperBound: 5, Count: 2}}}})
+	frame.update(clentUpdate{index: 5, value: SummaryValue{Count: 1, Sum: 2, Quantiles: []Quantile{{Quantile: 0.5, Value: 2}}}})
+	frame.update(clentUpdate{index: 6, value: WindowValue{Mode: AggregateMax, Value: 1, Count: 1, Min: 1, Max: 1, Sum: 1, Start: time.Now(), End: time.Now()}})
+	frame.remove(3)
+	data := frame.buffer.Bytes()
+
+	for size := 0; size < len(data); size++ {
+		DecodeMetricRecords(data[:size])
+	}
+	if records, err := DecodeMetricRecords(data); err != success || len(records) != 6 {
+		t.Errorf("decoded (%d) records: %v", len(records), err)
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	at := time.Unix(0, 1650000000123456789)
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"null", nil},
+		{"string", "some text"},
+		{"empty string", ""},
+		{"int", int64(-42)},
+		{"float", 3.25},
+		{"histogram", HistogramValue{Count: 3, Sum: 4.5, Buckets: []Bucket{{UpperBound: 1, Count: 1}, {UpperBound: math.Inf(1), Count: 3}}}},
+		{"summary", SummaryValue{Count: 2, Sum: 3, Quantiles: []Quantile{{Quantile: 0.5, Value: 1}, {Quantile: 0.99, Value: 2}}}},
+		{"window", WindowValue{Mode: AggregateMean, Value: 2, Count: 4, Min: 1, Max: 3, Sum: 8, Start: time.Unix(0, 100), End: time.Unix(0, 200)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := newMetricsFrame(MetricsWireV2)
+			if err := frame.update(clentUpdate{index: 300, value: test.value, time: at}); err != success {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			records, err := DecodeMetricRecords(frame.buffer.Bytes())
+			if err != success || len(records) != 1 {
+				t.Fatalf("decoded (%d) records: %v", len(records), err)
+			}
+			record := records[0]
+			if record.Kind != RecordUpdate || record.Index != 300 || !record.Time.Equal(at) {
+				t.Errorf("decoded %+v", record)
+			}
+			if !reflect.DeepEqual(record.Value, test.value) {
+				t.Errorf("decoded (%#v), expected (%#v)", record.Value, test.value)
+			}
+		})
+	}
+}
+
+func TestCodecPublishAndRemove(t *testing.T) {
+	member := &metricClient{id: "requests{code=200}", name: "Requests", units: "count", kind: TypeCounter, index: 70000,
+		family: "requests", labels: []Label{{Name: "code", Value: "200"}, {Name: "method", Value: "get"}}}
+
+	frame := newMetricsFrame(MetricsWireV2)
+	frame.publish(member)
+	frame.remove(70000)
+	records, err := DecodeMetricRecords(frame.buffer.Bytes())
+	if err != success || len(records) != 2 {
+		t.Fatalf("decoded (%d) records: %v", len(records), err)
+	}
+
+	expected := MetricRecord{Kind: RecordPublish, Index: 70000, ID: member.id, Name: member.name, Units: member.units,
+		Type: TypeCounter, Family: member.family, Labels: member.labels}
+	if !reflect.DeepEqual(records[0], expected) {
+		t.Errorf("decoded %+v, expected %+v", records[0], expected)
+	}
+	if records[1].Kind != RecordRemove || records[1].Index != 70000 {
+		t.Errorf("decoded %+v", records[1])
+	}
+}
+
+func TestCodecVersionDetection(t *testing.T) {
+	legacy := &metricClient{id: "legacy", name: "Legacy", units: "count", index: 5}
+	legacy.store(int64(7), time.Time{})
+
+	frame := newMetricsFrame(MetricsWireLegacy)
+	frame.publish(legacy)
+	frame.update(clentUpdate{index: 5, value: 3.5})
+
+	records, err := DecodeMetricRecords(frame.buffer.Bytes())
+	if err != success {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	expected := []MetricRecord{
+		{Kind: RecordPublish, Index: 5, ID: "legacy", Name: "Legacy", Units: "count"},
+		{Kind: RecordUpdate, Index: 5, Value: "7"}, // carried by the publish packet
+		{Kind: RecordUpdate, Index: 5, Value: "3.5"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("decoded %+v, expected %+v", records, expected)
+	}
+
+	if _, err := DecodeMetricRecords([]byte{metricsMagic, 3, byte(RecordRemove), 1, 1}); err != errUnsupportedVersion {
+		t.Errorf("a frame of a later version returned (%v)", err)
+	}
+	if records, err := DecodeMetricRecords([]byte{metricsMagic, MetricsWireV2}); err != success || len(records) != 0 {
+		t.Errorf("an empty frame returned (%d) records, %v", len(records), err)
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	large := &metricClient{id: "large", index: maxPacketIndex + 1}
+	long := strings.Repeat("x", maxMetricFieldSize+1)
+
+	tests := []struct {
+		name     string
+		version  int
+		encode   func(frame *metricsFrame) error
+		expected error
+	}{
+		{"legacy publish index", MetricsWireLegacy, func(frame *metricsFrame) error { return frame.publish(large) }, errIndexTooLarge},
+		{"legacy update index", MetricsWireLegacy, func(frame *metricsFrame) error {
+			return frame.update(clentUpdate{index: maxPacketIndex + 1, value: "x"})
+		}, errIndexTooLarge},
+		{"legacy value", MetricsWireLegacy, func(frame *metricsFrame) error {
+			return frame.update(clentUpdate{index: 1, value: strings.Repeat("x", maxLegacyValueSize+1)})
+		}, errValueTooLarge},
+		{"legacy remove", MetricsWireLegacy, func(frame *metricsFrame) error { return frame.remove(1) }, errUnsupportedRecord},
+		{"value", MetricsWireV2, func(frame *metricsFrame) error {
+			return frame.update(clentUpdate{index: 1, value: long})
+		}, errValueTooLarge},
+		{"field", MetricsWireV2, func(frame *metricsFrame) error {
+			return frame.publish(&metricClient{id: long, index: 1})
+		}, errValueTooLarge},
+		{"value type", MetricsWireV2, func(frame *metricsFrame) error {
+			return frame.update(clentUpdate{index: 1, value: []int{1}})
+		}, errUnsupportedValue},
+		{"large index", MetricsWireV2, func(frame *metricsFrame) error { return frame.publish(large) }, success},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := newMetricsFrame(test.version)
+			if err := test.encode(frame); err != test.expected {
+				t.Errorf("returned (%v), expected (%v)", err, test.expected)
+			}
+			if test.expected != success && !frame.empty() {
+				t.Errorf("the failed record made it into the frame")
+			}
+		})
+	}
+}
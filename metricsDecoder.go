@@ -0,0 +1,171 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// what the metrics decoder drives (on the receiving thread of the connection)
+	MetricsSink interface {
+		// a metric showed up (or its name, units or type changed)
+		OnDefine(id, name, units string)
+		// the value is one of: nil, string, int64, float64, HistogramValue, SummaryValue, WindowValue
+		// (version 1 streams carry strings only); the time is when it was received if the sender did not say
+		OnUpdate(id string, value interface{}, ts time.Time)
+	}
+
+	// a sink may also implement this one to learn about the metrics the sender dropped
+	MetricsRemoveSink interface {
+		OnRemove(id string)
+	}
+
+	// the current state of a metric, as decoded from the stream
+	MetricState struct {
+		ID     string
+		Name   string
+		Units  string
+		Type   MetricType
+		Family string
+		Labels []Label
+		Value  interface{}
+		Time   time.Time // of the last update (zero - no updates yet)
+	}
+
+	// decodes the metrics stream of a connection (either version), keeps the current values
+	// and passes what it decodes to the sink (if any); it implements Connection, the frames
+	// of the other streams are ignored:
+	//
+	//	CreateReceiver(port, func(props map[string]interface{}) Connection {
+	//		return NewMetricsDecoder(sink)
+	//	})
+	MetricsDecoder struct {
+		guard   sync.Mutex
+		sink    MetricsSink
+		indexes map[Index]string        // the ids of the published metrics
+		ids     map[string]Index        // the other way around (an id republished under a new index drops the old one)
+		metrics map[string]*MetricState // by id
+	}
+)
+
+func NewMetricsDecoder(sink MetricsSink) *MetricsDecoder {
+	return &MetricsDecoder{
+		sink:    sink,
+		indexes: make(map[Index]string),
+		ids:     make(map[string]Index),
+		metrics: make(map[string]*MetricState),
+	}
+}
+
+func (md *MetricsDecoder) OnNewMessage(id int, data []byte) {
+	if id != Metrics || len(data) == 0 {
+		return
+	}
+	if err := md.Decode(data); err != success {
+		warning("failed to decode metrics: %v\n", err)
+	}
+}
+
+func (md *MetricsDecoder) OnDisconnect(reason error) {
+	// the values are kept (for whoever reads them after the connection is gone)
+}
+
+// decodes one frame of the metrics stream; the records decoded before an error (if any) are applied
+func (md *MetricsDecoder) Decode(frame []byte) error {
+	records, err := DecodeMetricRecords(frame)
+
+	now := time.Now()
+	for _, record := range records {
+		md.apply(record, now)
+	}
+	return err
+}
+
+// the current state of the metric with the specified id
+func (md *MetricsDecoder) Metric(id string) (MetricState, bool) {
+	md.guard.Lock()
+	defer md.guard.Unlock()
+
+	if state, found := md.metrics[id]; found {
+		return *state, true
+	}
+	return MetricState{}, false
+}
+
+// the current state of all the metrics, sorted by id
+func (md *MetricsDecoder) Metrics() []MetricState {
+	md.guard.Lock()
+	states := make([]MetricState, 0, len(md.metrics))
+	for _, state := range md.metrics {
+		states = append(states, *state)
+	}
+	md.guard.Unlock()
+
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states
+}
+
+// note: the sink is called with the guard unlocked (so it can call back)
+func (md *MetricsDecoder) apply(record MetricRecord, now time.Time) {
+	md.guard.Lock()
+	id, known := md.indexes[record.Index]
+
+	switch record.Kind {
+	case RecordPublish:
+		state, found := md.metrics[record.ID]
+		changed := !found || state.Name != record.Name || state.Units != record.Units || state.Type != record.Type
+		if !found {
+			state = &MetricState{ID: record.ID}
+			md.metrics[record.ID] = state
+		}
+		state.Name, state.Units, state.Type = record.Name, record.Units, record.Type
+		state.Family, state.Labels = record.Family, record.Labels
+		if previous, found := md.ids[record.ID]; found && previous != record.Index && md.indexes[previous] == record.ID {
+			delete(md.indexes, previous) // e.g. the metric expired and came back, the old index may go to another one
+		}
+		md.indexes[record.Index] = record.ID
+		md.ids[record.ID] = record.Index
+		md.guard.Unlock()
+
+		if changed && md.sink != nil {
+			md.sink.OnDefine(record.ID, record.Name, record.Units)
+		}
+
+	case RecordUpdate:
+		if !known {
+			md.guard.Unlock()
+			return // not published (yet), nothing to attach it to
+		}
+		ts := record.Time
+		if ts.IsZero() {
+			ts = now
+		}
+		state := md.metrics[id]
+		state.Value, state.Time = record.Value, ts
+		md.guard.Unlock()
+
+		if md.sink != nil {
+			md.sink.OnUpdate(id, record.Value, ts)
+		}
+
+	case RecordRemove:
+		if known {
+			delete(md.indexes, record.Index)
+			delete(md.ids, id)
+			delete(md.metrics, id)
+		}
+		md.guard.Unlock()
+
+		if remover, ok := md.sink.(MetricsRemoveSink); ok && known {
+			remover.OnRemove(id)
+		}
+
+	default:
+		md.guard.Unlock()
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// records what the decoder drives
+type recordingSink struct {
+	events []string
+}
+
+func (sink *recordingSink) OnDefine(id, name, units string) {
+	sink.events = append(sink.events, fmt.Sprintf("define %s %s %s", id, name, units))
+}
+
+func (sink *recordingSink) OnUpdate(id string, value interface{}, ts time.Time) {
+	sink.events = append(sink.events, fmt.Sprintf("update %s %v", id, value))
+}
+
+func (sink *recordingSink) OnRemove(id string) {
+	sink.events = append(sink.events, "remove "+id)
+}
+
+func (sink *recordingSink) expect(t *testing.T, events ...string) {
+	t.Helper()
+	if !reflect.DeepEqual(sink.events, events) {
+		t.Errorf("got %q, expected %q", sink.events, events)
+	}
+	sink.events = nil
+}
+
+func decodeFrame(t *testing.T, decoder *MetricsDecoder, build func(frame *metricsFrame)) {
+	t.Helper()
+	frame := newMetricsFrame(MetricsWireV2)
+	build(frame)
+	if err := decoder.Decode(frame.buffer.Bytes()); err != success {
+		t.Fatalf("failed to decode: %v", err)
+	}
+}
+
+func TestDecoderDrivesSink(t *testing.T) {
+	sink := &recordingSink{}
+	decoder := NewMetricsDecoder(sink)
+	requests := &metricClient{id: "requests", name: "Requests", units: "count", kind: TypeCounter, index: 1}
+
+	decodeFrame(t, decoder, func(frame *metricsFrame) {
+		frame.update(clentUpdate{index: 1, value: int64(1)}) // not published yet
+		frame.publish(requests)
+		frame.update(clentUpdate{index: 1, value: int64(5), time: time.Unix(0, 100)})
+	})
+	sink.expect(t, "define requests Requests count", "update requests 5")
+
+	state, found := decoder.Metric("requests")
+	if !found || state.Type != TypeCounter || state.Value != int64(5) || !state.Time.Equal(time.Unix(0, 100)) {
+		t.Errorf("the state is %+v", state)
+	}
+
+	decodeFrame(t, decoder, func(frame *metricsFrame) {
+		frame.publish(requests) // nothing changed
+		frame.remove(1)
+		frame.update(clentUpdate{index: 1, value: int64(6)}) // removed
+	})
+	sink.expect(t, "remove requests")
+	if _, found := decoder.Metric("requests"); found || len(decoder.Metrics()) != 0 {
+		t.Errorf("the removed metric is still there")
+	}
+}
+
+// the metric expired and came back under another index, the old one went to another metric
+func TestDecoderRepublishedMetric(t *testing.T) {
+	sink := &recordingSink{}
+	decoder := NewMetricsDecoder(sink)
+	first := &metricClient{id: "first", name: "First", kind: TypeMetric, index: 1}
+
+	decodeFrame(t, decoder, func(frame *metricsFrame) {
+		frame.publish(first)
+		first.index = 2
+		frame.publish(first)
+		frame.update(clentUpdate{index: 1, value: "stale index"})
+		frame.update(clentUpdate{index: 2, value: "new index"})
+	})
+	sink.expect(t, "define first First ", "update first new index")
+
+	// the type changed, the sink is told (the name and units are the same)
+	decodeFrame(t, decoder, func(frame *metricsFrame) {
+		frame.publish(&metricClient{id: "first", name: "First", kind: TypeGauge, index: 2})
+	})
+	sink.expect(t, "define first First ")
+	if state, _ := decoder.Metric("first"); state.Type != TypeGauge {
+		t.Errorf("the type is (%v)", state.Type)
+	}
+}
+
+func TestDecoderLegacyStream(t *testing.T) {
+	sink := &recordingSink{}
+	decoder := NewMetricsDecoder(sink)
+	legacy := &metricClient{id: "legacy", name: "Legacy", units: "count", index: 3}
+	legacy.store(int64(7), time.Time{})
+
+	frame := newMetricsFrame(MetricsWireLegacy)
+	frame.publish(legacy)
+	frame.update(clentUpdate{index: 3, value: int64(8)})
+	decoder.OnNewMessage(Metrics, frame.buffer.Bytes())
+	decoder.OnNewMessage(Stdout, []byte("not metrics"))
+
+	sink.expect(t, "define legacy Legacy count", "update legacy 7", "update legacy 8")
+	if state, _ := decoder.Metric("legacy"); state.Value != "8" || state.Time.IsZero() {
+		t.Errorf("the state is %+v", state)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"expvar"
+)
+
+var (
+	expvarInitialized bool
+	expvarMetrics     *expvar.Map // nil if disabled ("metrics.expvar") or the name is taken by something else
+)
+
+// every registered metric is published (as /debug/vars has them) in an expvar.Map named after the service
+// ("service.name"), unless the "metrics.expvar" flag is cleared; the values are read when the vars are,
+// so they are always current: counters and gauges are numbers, string metrics are strings.
+// note: expects metricsGuard to be locked
+func exportExpvar(ms *metricClient) {
+	if vars := expvarMap(); vars != nil {
+		vars.Set(ms.id, expvar.Func(func() interface{} {
+			return jsonValue(ms.liveValue())
+		}))
+	}
+}
+
+// note: expects metricsGuard to be locked
+func unexportExpvar(ms *metricClient) {
+	if vars := expvarMap(); vars != nil {
+		vars.Delete(ms.id)
+	}
+}
+
+// note: expects metricsGuard to be locked
+func expvarMap() *expvar.Map {
+	if expvarInitialized {
+		return expvarMetrics
+	}
+	expvarInitialized = true
+
+	if !GetFlag("metrics.expvar", true) {
+		return nil
+	}
+
+	// note: expvar has no way to unpublish, so the map is reused (e.g. after ResetState)
+	name := GetValue("service.name", "preference.service")
+	switch existing := expvar.Get(name).(type) {
+	case nil:
+		expvarMetrics = expvar.NewMap(name)
+	case *expvar.Map:
+		expvarMetrics = existing
+	default:
+		warning("the expvar name '%s' is taken, the metrics are not published there\n", name)
+	}
+	return expvarMetrics
+}
+
+// note: expects metricsGuard to be locked
+func resetExpvar() {
+	if expvarMetrics != nil {
+		expvarMetrics.Init()
+	}
+	expvarInitialized = false
+	expvarMetrics = nil
+}
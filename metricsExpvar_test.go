@@ -0,0 +1,78 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+func expvarMetrics(t *testing.T) *expvar.Map {
+	name := base.GetValue("service.name", "preference.service")
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		t.Fatalf("the metrics are not published as (%s)", name)
+	}
+	return vars
+}
+
+// the vars are current without a flush, the unregistered metrics are dropped
+func TestExpvar(t *testing.T) {
+	basetest.New(t)
+
+	jobs := base.CreateNewCounter("jobs", "Jobs", "count")
+	jobs.Add(5)
+	base.CreateNewGauge("load", "Load", "").Set(1.5)
+	base.CreateNewMetric("state", "State", "").Update("ready")
+	vars := expvarMetrics(t)
+
+	expected := map[string]string{"jobs": "5", "load": "1.5", "state": `"ready"`}
+	for id, value := range expected {
+		if v := vars.Get(id); v == nil || v.String() != value {
+			t.Errorf("var (%s) is (%v), expected (%s)", id, v, value)
+		}
+	}
+	jobs.Add(2)
+	if v := vars.Get("jobs"); v == nil || v.String() != "7" {
+		t.Errorf("var (jobs) is (%v), expected (7)", v)
+	}
+
+	jobs.Unregister()
+	if v := vars.Get("jobs"); v != nil {
+		t.Errorf("the unregistered metric is still published as (%v)", v)
+	}
+}
+
+// /debug/vars has the map, a reset empties it
+func TestExpvarHandler(t *testing.T) {
+	basetest.New(t)
+	base.CreateNewCounter("stale", "Stale", "count").Add(1)
+
+	basetest.New(t)
+	base.CreateNewCounter("served", "Served", "count").Add(3)
+
+	recorder := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/vars", nil))
+
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	var metrics map[string]interface{}
+	if err := json.Unmarshal(vars[base.GetValue("service.name", "preference.service")], &metrics); err != nil {
+		t.Fatalf("the metrics are not served: %v", err)
+	}
+	if metrics["served"] != 3.0 {
+		t.Errorf("unexpected metrics: %v", metrics)
+	}
+	if _, found := metrics["stale"]; found {
+		t.Errorf("a metric of the previous state is served: %v", metrics)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPersistInterval = 30 * time.Second
+	persistFileVersion     = 1
+	suffixCorrupt          = ".corrupt"
+)
+
+type (
+	// what the state file has (see "metrics.persist.file")
+	persistFile struct {
+		Version  int              `json:"version"`
+		Checksum uint32           `json:"checksum"` // crc32 (IEEE) of the counters, as they are marshaled
+		Counters map[string]int64 `json:"counters"`
+	}
+)
+
+var (
+	persistGuard    sync.Mutex
+	persistLoaded   bool
+	persistFilename string               // empty - persistence is not configured
+	persistValues   = map[string]int64{} // as of the last checkpoint (or as restored), by id
+	persistCounters = map[string]*metricClient{}
+	persistWritten  = map[string]int64{} // what the state file has
+	persistStop     chan bool            // nil if the checkpoints are not running
+)
+
+// creates a counter whose value survives restarts: it is restored (from the state file named by
+// "metrics.persist.file") on creation and checkpointed there every "metrics.persist.interval" (30s by default);
+// without the file configured it is just a counter. the counters created with CreateNewCounter are
+// persisted as well if their ids match one of the patterns (see MatchString) in "metrics.persist.counters"
+// (separated by ';').
+// note: the updates since the last checkpoint are lost unless CheckpointCounters is called before exiting
+func CreatePersistentCounter(id, name, units string) Counter {
+	return Counter(createPersistentCounter(id, name, units))
+}
+
+// writes the values of the persistent counters to the state file (if they changed since the last time)
+func CheckpointCounters() error {
+	persistGuard.Lock()
+	defer persistGuard.Unlock()
+
+	if len(persistFilename) == 0 {
+		return errNoStateFile
+	}
+	return checkpointCounters()
+}
+
+// whether the counter is to be persisted as per "metrics.persist.counters"
+func persistSelected(id string) bool {
+	patterns := []string{}
+	for _, pattern := range strings.Split(GetValue("metrics.persist.counters", ""), ";") {
+		if pattern = strings.TrimSpace(pattern); len(pattern) > 0 {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return len(patterns) > 0 && matchAny(id, patterns)
+}
+
+// the value is restored before the counter is registered, so it is never taken for an increment (see statsdExporter)
+func createPersistentCounter(id, name, units string) *metricClient {
+	value, restore := persistedValue(id)
+
+	var prepared *metricClient
+	ms := createNewMetric(id, name, units, TypeCounter, func(ms *metricClient) {
+		prepared = ms
+		if restore {
+			atomic.StoreInt64(&ms.counter, value)
+			ms.origin = value
+			ms.store(value, time.Now())
+		}
+	})
+	if !persistCounter(ms) || !restore {
+		return ms
+	}
+
+	if ms != prepared {
+		// the counter existed before it was made persistent, the restored value is just an update
+		ms.Set(value)
+	} else {
+		// the value is not a change (see post), the receiver is told about it nevertheless
+		ms.send(clentUpdate{index: ms.currentIndex(), value: value, time: time.Now()})
+	}
+	return ms
+}
+
+// the value to restore the counter with, if there is one (and the counter was not created already)
+func persistedValue(id string) (int64, bool) {
+	persistGuard.Lock()
+	defer persistGuard.Unlock()
+
+	loadPersistedCounters()
+	if _, found := persistCounters[id]; found {
+		return 0, false
+	}
+	value, found := persistValues[id]
+	return value, found
+}
+
+// false if the counter is not (newly) persisted
+func persistCounter(ms *metricClient) bool {
+	persistGuard.Lock()
+	defer persistGuard.Unlock()
+
+	loadPersistedCounters()
+	if len(persistFilename) == 0 {
+		warning("the counter '%s' is not persisted ('metrics.persist.file' is not set)\n", ms.id)
+		return false
+	}
+	if _, found := persistCounters[ms.id]; found {
+		return false // a redundant creation (see createNewMetric), it was restored already
+	}
+	if atomic.LoadInt32(&ms.state) == metricUnregistered {
+		return false // e.g. an id taken by a metric of another kind
+	}
+	persistCounters[ms.id] = ms
+
+	if persistStop == nil {
+		persistStop = make(chan bool)
+		interval := GetDuration("metrics.persist.interval", time.Second, 24*time.Hour, defaultPersistInterval)
+		go runCheckpoints(interval, persistStop)
+	}
+	return true
+}
+
+// an unregistered counter is no longer checkpointed, its last value is kept (for the counter created next with its id)
+func forgetPersistentCounter(ms *metricClient) {
+	persistGuard.Lock()
+	defer persistGuard.Unlock()
+
+	if persistCounters[ms.id] != ms {
+		return
+	}
+	persistValues[ms.id] = atomic.LoadInt64(&ms.counter)
+	delete(persistCounters, ms.id)
+}
+
+// reads the state file, once; a corrupt one is set aside (renamed) and the counters start from zero
+// note: expects persistGuard to be locked
+func loadPersistedCounters() {
+	if persistLoaded {
+		return
+	}
+	persistLoaded = true
+
+	persistFilename = GetValue("metrics.persist.file", "")
+	if len(persistFilename) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(persistFilename)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == success {
+		err = decodePersistFile(data)
+	}
+	if err != success {
+		warning("failed to restore the persistent counters (%s): %v\n", persistFilename, err)
+		if err := os.Rename(persistFilename, persistFilename+suffixCorrupt); err != success && !os.IsNotExist(err) {
+			warning("failed to set aside the state file (%s): %v\n", persistFilename, err)
+		}
+	}
+}
+
+// note: expects persistGuard to be locked
+func decodePersistFile(data []byte) error {
+	var file persistFile
+	if err := json.Unmarshal(data, &file); err != success {
+		return errCorruptStateFile
+	}
+	if file.Version != persistFileVersion {
+		return errUnsupportedVersion
+	}
+	if file.Counters == nil || persistChecksum(file.Counters) != file.Checksum {
+		return errCorruptStateFile
+	}
+
+	for id, value := range file.Counters {
+		persistValues[id] = value
+		persistWritten[id] = value
+	}
+	return success
+}
+
+func persistChecksum(counters map[string]int64) uint32 {
+	data, _ := json.Marshal(counters) // note: the keys are sorted, so it is the same for the same counters
+	return crc32.ChecksumIEEE(data)
+}
+
+func runCheckpoints(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			persistGuard.Lock()
+			if err := checkpointCounters(); err != success {
+				warning("failed to checkpoint the persistent counters (%s): %v\n", persistFilename, err)
+			}
+			persistGuard.Unlock()
+		}
+	}
+}
+
+// the counters that were restored but not created (yet) keep their values
+// note: expects persistGuard to be locked
+func checkpointCounters() error {
+	for id, ms := range persistCounters {
+		persistValues[id] = atomic.LoadInt64(&ms.counter)
+	}
+	if sameCounters(persistValues, persistWritten) {
+		return success
+	}
+
+	counters := make(map[string]int64, len(persistValues))
+	for id, value := range persistValues {
+		counters[id] = value
+	}
+	file := persistFile{Version: persistFileVersion, Checksum: persistChecksum(counters), Counters: counters}
+	data, err := json.Marshal(file)
+	if err != success {
+		return err
+	}
+	if err := writeFileAtomically(persistFilename, data); err != success {
+		return err
+	}
+	persistWritten = counters
+	return success
+}
+
+func sameCounters(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, value := range a {
+		if other, found := b[id]; !found || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// note: the state file stays (the counters are restored from it again)
+func resetPersistence() {
+	persistGuard.Lock()
+	defer persistGuard.Unlock()
+
+	if persistStop != nil {
+		close(persistStop)
+		persistStop = nil
+	}
+	persistLoaded = false
+	persistFilename = ""
+	persistValues = map[string]int64{}
+	persistCounters = map[string]*metricClient{}
+	persistWritten = map[string]int64{}
+}
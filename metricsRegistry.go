@@ -0,0 +1,82 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"sync/atomic"
+)
+
+// keeps the metrics both by index (a slot in a slice that grows as needed) and by id;
+// the indexes of removed metrics are reused once released (i.e. once the receiver was told about the removal).
+// note: the registry itself is not guarded, see metricsGuard
+type metricsRegistry struct {
+	slots   []*metricClient // index -> metric; slot 0 is never used
+	ids     map[string]*metricClient
+	vacant  []Index        // released indexes, these are reused first
+	retired map[Index]bool // the indexes of removed metrics, not released yet
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		slots:   make([]*metricClient, 1, 64),
+		ids:     make(map[string]*metricClient),
+		retired: make(map[Index]bool),
+	}
+}
+
+// assigns an index to the metric and keeps it
+func (registry *metricsRegistry) add(ms *metricClient) {
+	// note: the index is read (atomically) without the guard, see metricClient.post
+	if count := len(registry.vacant); count > 0 {
+		atomic.StoreUint32(&ms.index, registry.vacant[count-1])
+		registry.vacant = registry.vacant[:count-1]
+		registry.slots[ms.index] = ms
+	} else {
+		atomic.StoreUint32(&ms.index, Index(len(registry.slots)))
+		registry.slots = append(registry.slots, ms)
+	}
+	registry.ids[ms.id] = ms
+}
+
+func (registry *metricsRegistry) remove(ms *metricClient) {
+	if registry.get(ms.index) != ms {
+		return
+	}
+	registry.slots[ms.index] = nil
+	registry.retired[ms.index] = true
+	delete(registry.ids, ms.id)
+}
+
+// makes the index of a removed metric available again
+func (registry *metricsRegistry) release(index Index) {
+	if registry.retired[index] {
+		delete(registry.retired, index)
+		registry.vacant = append(registry.vacant, index)
+	}
+}
+
+func (registry *metricsRegistry) get(index Index) *metricClient {
+	if index == 0 || int(index) >= len(registry.slots) {
+		return nil
+	}
+	return registry.slots[index]
+}
+
+func (registry *metricsRegistry) lookup(id string) *metricClient {
+	return registry.ids[id]
+}
+
+func (registry *metricsRegistry) count() int {
+	return len(registry.ids)
+}
+
+// calls the func for every metric, in the order of indexes
+func (registry *metricsRegistry) each(fn func(*metricClient)) {
+	for _, ms := range registry.slots {
+		if ms != nil {
+			fn(ms)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"strconv"
+	"testing"
+)
+
+// the registry used to be a fixed store of 100 slots, the 100th metric was out of range
+func TestRegistryGrows(t *testing.T) {
+	registry := newMetricsRegistry()
+
+	for i := 1; i <= 1000; i++ {
+		ms := &metricClient{id: "grows." + strconv.Itoa(i)}
+		registry.add(ms)
+		if ms.index != Index(i) {
+			t.Fatalf("metric (%s) got index (%d)", ms.id, ms.index)
+		}
+	}
+	if registry.count() != 1000 {
+		t.Errorf("registry has (%d) metrics, expected (1000)", registry.count())
+	}
+	if ms := registry.lookup("grows.100"); ms == nil || registry.get(ms.index) != ms {
+		t.Errorf("the 100th metric is not found")
+	}
+}
+
+// the index of a removed metric is reused once released, not before
+func TestRegistryReusesReleasedIndex(t *testing.T) {
+	registry := newMetricsRegistry()
+
+	removed := &metricClient{id: "reuse.removed"}
+	registry.add(removed)
+	registry.add(&metricClient{id: "reuse.kept"})
+	registry.remove(removed)
+
+	early := &metricClient{id: "reuse.early"}
+	registry.add(early)
+	if early.index == removed.index {
+		t.Errorf("the index (%d) was reused before being released", early.index)
+	}
+	if registry.lookup("reuse.removed") != nil || registry.get(removed.index) != nil {
+		t.Errorf("the removed metric is still registered")
+	}
+
+	registry.release(removed.index)
+	registry.release(removed.index) // once only
+	late := &metricClient{id: "reuse.late"}
+	registry.add(late)
+	if late.index != removed.index {
+		t.Errorf("got index (%d), expected the released one (%d)", late.index, removed.index)
+	}
+	next := &metricClient{id: "reuse.next"}
+	registry.add(next)
+	if next.index == late.index {
+		t.Errorf("the released index was given away twice")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	contentTypeJSON = "application/json"
+)
+
+type (
+	// the JSON form of a metric (see SnapshotHandler)
+	metricJSON struct {
+		ID     string            `json:"id"`
+		Name   string            `json:"name"`
+		Units  string            `json:"units,omitempty"`
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels,omitempty"`
+		Value  interface{}       `json:"value"`
+		Time   *time.Time        `json:"time,omitempty"`
+	}
+)
+
+// returns the current state of the metrics (of this process) whose ids match any of the patterns
+// (see MatchString), all of them if there are no patterns; in the order they were registered
+//
+//	queues := base.SnapshotMetrics("queue.*.depth")
+func SnapshotMetrics(patterns ...string) []MetricState {
+	metricsGuard.Lock()
+	defer metricsGuard.Unlock()
+
+	states := make([]MetricState, 0, metricsStore.count())
+	metricsStore.each(func(ms *metricClient) {
+		if !matchAny(ms.id, patterns) {
+			return
+		}
+
+		states = append(states, MetricState{
+			ID:     ms.id,
+			Name:   ms.name,
+			Units:  ms.units,
+			Type:   ms.kind,
+			Family: ms.family,
+			Labels: ms.labels,
+			Value:  ms.liveValue(),
+			Time:   ms.current().time,
+		})
+	})
+	return states
+}
+
+// the value as of now: counters and gauges are ahead of the last sample
+func (ms *metricClient) liveValue() interface{} {
+	switch ms.kind {
+	case TypeCounter:
+		return atomic.LoadInt64(&ms.counter)
+	case TypeGauge:
+		return math.Float64frombits(atomic.LoadUint64(&ms.gauge))
+	default:
+		return ms.current().value
+	}
+}
+
+// serves the snapshot of the metrics as JSON, the "match" parameters (if any) are the patterns:
+//
+//	http.Handle("/debug/metrics", base.SnapshotHandler())
+//	curl "localhost:8080/debug/metrics?match=http.*&match=queue.*"
+func SnapshotHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		states := SnapshotMetrics(r.URL.Query()["match"]...)
+
+		metrics := make([]metricJSON, 0, len(states))
+		for _, state := range states {
+			metrics = append(metrics, toMetricJSON(state))
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(metrics); err != success {
+			warning("failed to write the metrics: %v\n", err)
+		}
+	})
+}
+
+func matchAny(id string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := MatchString(id, pattern); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func toMetricJSON(state MetricState) metricJSON {
+	metric := metricJSON{
+		ID:    state.ID,
+		Name:  state.Name,
+		Units: state.Units,
+		Type:  state.Type.String(),
+		Value: jsonValue(state.Value),
+	}
+	if !state.Time.IsZero() {
+		metric.Time = &state.Time
+	}
+	if len(state.Labels) > 0 {
+		metric.Labels = make(map[string]string, len(state.Labels))
+		for _, label := range state.Labels {
+			metric.Labels[label.Name] = label.Value
+		}
+	}
+	return metric
+}
+
+// json has no NaN or infinities, these (and the values that have them) are turned into what it can take
+func jsonValue(value interface{}) interface{} {
+	switch actual := value.(type) {
+	case float64:
+		return jsonFloat(actual)
+
+	case HistogramValue:
+		buckets := make([]map[string]interface{}, len(actual.Buckets))
+		for i, bucket := range actual.Buckets {
+			buckets[i] = map[string]interface{}{"le": jsonFloat(bucket.UpperBound), "count": bucket.Count}
+		}
+		return map[string]interface{}{"count": actual.Count, "sum": jsonFloat(actual.Sum), "buckets": buckets}
+
+	case SummaryValue:
+		quantiles := make([]map[string]interface{}, len(actual.Quantiles))
+		for i, q := range actual.Quantiles {
+			quantiles[i] = map[string]interface{}{"quantile": jsonFloat(q.Quantile), "value": jsonFloat(q.Value)}
+		}
+		return map[string]interface{}{"count": actual.Count, "sum": jsonFloat(actual.Sum), "quantiles": quantiles}
+
+	case WindowValue:
+		return map[string]interface{}{
+			"mode":  actual.Mode.String(),
+			"value": jsonFloat(actual.Value),
+			"count": actual.Count,
+			"min":   jsonFloat(actual.Min),
+			"max":   jsonFloat(actual.Max),
+			"sum":   jsonFloat(actual.Sum),
+			"start": actual.Start,
+			"end":   actual.End,
+		}
+
+	default:
+		return value
+	}
+}
+
+// NaN and infinities become strings (as Prometheus has them)
+func jsonFloat(value float64) interface{} {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return promFloat(value)
+	}
+	return value
+}
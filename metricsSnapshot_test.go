@@ -0,0 +1,91 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base_test
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+func snapshotIds(states []base.MetricState) []string {
+	ids := []string{}
+	for _, state := range states {
+		ids = append(ids, state.ID)
+	}
+	return ids
+}
+
+func TestSnapshotMetrics(t *testing.T) {
+	basetest.New(t)
+
+	base.CreateNewGauge("queue.in.depth", "Inbound", "count").Set(3)
+	base.CreateNewCounter("http.requests", "Requests", "count").Add(5)
+	base.CreateNewGauge("queue.out.depth", "Outbound", "count").Set(4)
+	base.CreateNewMetric("queue.out.state", "State", "").Update("idle")
+
+	tests := []struct {
+		patterns []string
+		expected []string
+	}{
+		{nil, []string{"queue.in.depth", "http.requests", "queue.out.depth", "queue.out.state"}},
+		{[]string{"queue.*.depth"}, []string{"queue.in.depth", "queue.out.depth"}},
+		{[]string{"http.*", "queue.out.*"}, []string{"http.requests", "queue.out.depth", "queue.out.state"}},
+		{[]string{"nothing.*"}, []string{}},
+	}
+	for _, test := range tests {
+		if ids := snapshotIds(base.SnapshotMetrics(test.patterns...)); !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("patterns %q matched %q, expected %q", test.patterns, ids, test.expected)
+		}
+	}
+
+	// the values are live, not as of the last flush
+	states := base.SnapshotMetrics("http.requests")
+	if len(states) != 1 || states[0].Value != int64(5) || states[0].Type != base.TypeCounter || states[0].Units != "count" {
+		t.Errorf("unexpected state: %+v", states)
+	}
+}
+
+func TestSnapshotHandler(t *testing.T) {
+	basetest.New(t)
+
+	base.CreateNewCounter("http.requests", "Requests", "count").Add(5)
+	base.CreateNewGauge("http.ratio", "Ratio", "").Set(math.NaN())
+	base.CreateCounterVec("http.codes", "Codes", "count", "code").With("200").Add(2)
+	base.CreateNewGauge("queue.depth", "Depth", "count").Set(3)
+
+	recorder := httptest.NewRecorder()
+	base.SnapshotHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/metrics?match=http.*", nil))
+	if kind := recorder.Header().Get("Content-Type"); kind != "application/json" {
+		t.Errorf("unexpected content type (%s)", kind)
+	}
+
+	var metrics []map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &metrics); err != nil {
+		t.Fatalf("failed to decode (%s): %v", recorder.Body.String(), err)
+	}
+	byID := map[string]map[string]interface{}{}
+	for _, metric := range metrics {
+		byID[metric["id"].(string)] = metric
+	}
+	if len(metrics) != 3 || byID["queue.depth"] != nil {
+		t.Errorf("the match did not filter the metrics: %s", recorder.Body.String())
+	}
+	if requests := byID["http.requests"]; requests == nil || requests["value"] != 5.0 || requests["type"] != "counter" {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+	if ratio := byID["http.ratio"]; ratio == nil || ratio["value"] != "NaN" {
+		t.Errorf("unexpected ratio: %v", ratio)
+	}
+	codes, _ := byID[`http.codes{code="200"}`]["labels"].(map[string]interface{})
+	if codes["code"] != "200" {
+		t.Errorf("the labels are missing: %s", recorder.Body.String())
+	}
+}
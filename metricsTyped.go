@@ -0,0 +1,304 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxSummarySamples = 1024 // per tick, beyond that the samples are picked at random (reservoir sampling)
+)
+
+var (
+	DefaultBuckets   = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	DefaultQuantiles = []float64{.5, .9, .99}
+)
+
+type (
+	Gauge interface {
+		Set(float64)
+		Add(float64)
+		Unregister()
+	}
+
+	Observer interface {
+		Observe(float64)
+	}
+
+	Histogram interface {
+		Observer
+		Unregister()
+	}
+
+	Summary interface {
+		Observer
+		Unregister()
+	}
+
+	// the value of a histogram: cumulative since the metric was created
+	HistogramValue struct {
+		Count   uint64
+		Sum     float64
+		Buckets []Bucket
+	}
+
+	Bucket struct {
+		UpperBound float64
+		Count      uint64 // cumulative: the number of observations less than or equal to UpperBound
+	}
+
+	// the value of a summary: count and sum are cumulative, the quantiles are of the last tick
+	SummaryValue struct {
+		Count     uint64
+		Sum       float64
+		Quantiles []Quantile
+	}
+
+	Quantile struct {
+		Quantile float64
+		Value    float64
+	}
+
+	// measures the time from its creation till ObserveDuration is called
+	Timer struct {
+		observer Observer
+		start    time.Time
+	}
+
+	gaugeClient struct {
+		*metricClient
+	}
+
+	observerClient struct {
+		*metricClient
+	}
+
+	// what the collector keeps for a histogram or a summary
+	observations struct {
+		metric  *metricClient
+		count   uint64
+		sum     float64
+		buckets []uint64  // per bucket (not cumulative), the last one is +Inf
+		samples []float64 // of the current tick
+		seen    int64     // observations in the current tick
+	}
+)
+
+func CreateNewGauge(id, name, units string) Gauge {
+	return &gaugeClient{createNewMetric(id, name, units, TypeGauge, nil)}
+}
+
+// buckets are the upper bounds (the +Inf bucket is implied), DefaultBuckets are used if none are specified
+func CreateNewHistogram(id, name, units string, buckets ...float64) Histogram {
+	bounds := sortedOrDefault(buckets, DefaultBuckets)
+
+	return &observerClient{createNewMetric(id, name, units, TypeHistogram, func(ms *metricClient) {
+		ms.buckets = bounds
+	})}
+}
+
+// DefaultQuantiles are used if none are specified
+func CreateNewSummary(id, name, units string, quantiles ...float64) Summary {
+	qs := sortedOrDefault(quantiles, DefaultQuantiles)
+
+	return &observerClient{createNewMetric(id, name, units, TypeSummary, func(ms *metricClient) {
+		ms.quantiles = qs
+	})}
+}
+
+// starts the timer, the observer is usually a histogram or a summary (with "seconds" as units)
+//
+//	timer := base.NewTimer(latency)
+//	defer timer.ObserveDuration()
+func NewTimer(observer Observer) *Timer {
+	return &Timer{observer: observer, start: time.Now()}
+}
+
+// observes (in seconds) the time since the timer was created
+func (timer *Timer) ObserveDuration() time.Duration {
+	elapsed := time.Since(timer.start)
+	if timer.observer != nil {
+		timer.observer.Observe(elapsed.Seconds())
+	}
+	return elapsed
+}
+
+func (gc *gaugeClient) Set(value float64) {
+	atomic.StoreUint64(&gc.gauge, math.Float64bits(value))
+	gc.post(value)
+}
+
+func (gc *gaugeClient) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&gc.gauge)
+		value := math.Float64frombits(old) + delta
+		if atomic.CompareAndSwapUint64(&gc.gauge, old, math.Float64bits(value)) {
+			gc.post(value)
+			return
+		}
+	}
+}
+
+// the observations are aggregated by the collector (see summarize)
+func (oc *observerClient) Observe(value float64) {
+	if !oc.alive() {
+		return
+	}
+	now := time.Now()
+	oc.touch(now)
+	oc.send(clentUpdate{
+		index:    oc.currentIndex(),
+		value:    value,
+		time:     now,
+		observed: true,
+	})
+}
+
+// note: called on the collector's goroutine
+func observe(observed map[Index]*observations, update clentUpdate) {
+	value, ok := update.value.(float64)
+	if !ok {
+		return
+	}
+
+	metricsGuard.Lock()
+	metric := metricsStore.get(update.index)
+	metricsGuard.Unlock()
+
+	if metric == nil {
+		return // gone already
+	}
+
+	entry := observed[update.index]
+	if entry == nil || entry.metric != metric {
+		entry = &observations{metric: metric}
+		if metric.kind == TypeHistogram {
+			entry.buckets = make([]uint64, len(metric.buckets)+1)
+		}
+		observed[update.index] = entry
+	}
+
+	entry.count++
+	entry.sum += value
+	entry.seen++
+
+	switch metric.kind {
+	case TypeHistogram:
+		bucket := sort.SearchFloat64s(metric.buckets, value) // the first bound >= value
+		entry.buckets[bucket]++
+	case TypeSummary:
+		if len(entry.samples) < maxSummarySamples {
+			entry.samples = append(entry.samples, value)
+		} else if slot := rand.Int63n(entry.seen); slot < maxSummarySamples {
+			entry.samples[slot] = value
+		}
+	}
+}
+
+// turns the observations of the current tick into updates
+// note: called on the collector's goroutine
+func summarize(observed map[Index]*observations, updates map[Index]clentUpdate) {
+	now := time.Now()
+	for index, entry := range observed {
+		if entry.seen == 0 {
+			continue
+		}
+
+		var value interface{}
+		switch entry.metric.kind {
+		case TypeHistogram:
+			value = entry.histogram()
+		case TypeSummary:
+			value = entry.summary()
+		}
+		entry.seen = 0
+		entry.samples = entry.samples[:0]
+
+		entry.metric.store(value, now)
+
+		updates[index] = clentUpdate{index: index, value: value, time: now}
+	}
+}
+
+func (entry *observations) histogram() HistogramValue {
+	value := HistogramValue{
+		Count:   entry.count,
+		Sum:     entry.sum,
+		Buckets: make([]Bucket, len(entry.metric.buckets)),
+	}
+
+	var cumulative uint64
+	for i, bound := range entry.metric.buckets {
+		cumulative += entry.buckets[i]
+		value.Buckets[i] = Bucket{UpperBound: bound, Count: cumulative}
+	}
+	return value
+}
+
+func (entry *observations) summary() SummaryValue {
+	value := SummaryValue{
+		Count:     entry.count,
+		Sum:       entry.sum,
+		Quantiles: make([]Quantile, len(entry.metric.quantiles)),
+	}
+
+	samples := entry.samples
+	sort.Float64s(samples)
+	for i, q := range entry.metric.quantiles {
+		value.Quantiles[i] = Quantile{Quantile: q, Value: quantile(samples, q)}
+	}
+	return value
+}
+
+// nearest-rank quantile of sorted samples
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func (value HistogramValue) String() string {
+	parts := []string{sprintf("count=%d", value.Count), sprintf("sum=%v", value.Sum)}
+	for _, bucket := range value.Buckets {
+		parts = append(parts, sprintf("le%v=%d", bucket.UpperBound, bucket.Count))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (value SummaryValue) String() string {
+	parts := []string{sprintf("count=%d", value.Count), sprintf("sum=%v", value.Sum)}
+	for _, q := range value.Quantiles {
+		parts = append(parts, sprintf("q%v=%v", q.Quantile, q.Value))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (kind MetricType) String() string {
+	switch kind {
+	case TypeCounter:
+		return "counter"
+	case TypeGauge:
+		return "gauge"
+	case TypeHistogram:
+		return "histogram"
+	case TypeSummary:
+		return "summary"
+	default:
+		return "metric"
+	}
+}
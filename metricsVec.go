@@ -0,0 +1,235 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMaxSeries = 1000
+	overflowLabel    = "_overflow_" // the value of every label of the overflow series
+)
+
+type (
+	// a label of a member of a metric vector
+	Label struct {
+		Name  string
+		Value string
+	}
+
+	// a family of counters told apart by their labels
+	//
+	//	requests := base.CreateCounterVec("http.requests", "Requests", "count", "method", "code")
+	//	requests.With("GET", "200").Add(1)
+	CounterVec struct {
+		vec *metricVec
+	}
+
+	GaugeVec struct {
+		vec *metricVec
+	}
+
+	HistogramVec struct {
+		vec *metricVec
+	}
+
+	SummaryVec struct {
+		vec *metricVec
+	}
+
+	MetricVec struct {
+		vec *metricVec
+	}
+
+	// the members are regular metrics, their ids are made of the id of the vector and the label set,
+	// e.g. http.requests{method="GET",code="200"}
+	metricVec struct {
+		id         string
+		name       string
+		units      string
+		kind       MetricType
+		labelNames []string
+		setup      func(*metricClient)
+
+		guard    sync.Mutex
+		members  map[string]*metricClient // by the (joined) label values
+		limit    int
+		overflow *metricClient
+	}
+)
+
+func CreateCounterVec(id, name, units string, labelNames ...string) *CounterVec {
+	return &CounterVec{newMetricVec(id, name, units, TypeCounter, labelNames, nil)}
+}
+
+func CreateGaugeVec(id, name, units string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newMetricVec(id, name, units, TypeGauge, labelNames, nil)}
+}
+
+// the members share the buckets (DefaultBuckets are used if none are specified), see CreateNewHistogram
+func CreateHistogramVec(id, name, units string, buckets []float64, labelNames ...string) *HistogramVec {
+	bounds := sortedOrDefault(buckets, DefaultBuckets)
+	return &HistogramVec{newMetricVec(id, name, units, TypeHistogram, labelNames, func(ms *metricClient) {
+		ms.buckets = bounds
+	})}
+}
+
+// the members share the quantiles (DefaultQuantiles are used if none are specified), see CreateNewSummary
+func CreateSummaryVec(id, name, units string, quantiles []float64, labelNames ...string) *SummaryVec {
+	qs := sortedOrDefault(quantiles, DefaultQuantiles)
+	return &SummaryVec{newMetricVec(id, name, units, TypeSummary, labelNames, func(ms *metricClient) {
+		ms.quantiles = qs
+	})}
+}
+
+func CreateMetricVec(id, name, units string, labelNames ...string) *MetricVec {
+	return &MetricVec{newMetricVec(id, name, units, TypeMetric, labelNames, nil)}
+}
+
+// the label values go in the order of the label names (the vector was created with)
+func (cv *CounterVec) With(labelValues ...string) Counter {
+	return cv.vec.with(labelValues)
+}
+
+func (gv *GaugeVec) With(labelValues ...string) Gauge {
+	return &gaugeClient{gv.vec.with(labelValues)}
+}
+
+func (hv *HistogramVec) With(labelValues ...string) Histogram {
+	return &observerClient{hv.vec.with(labelValues)}
+}
+
+func (sv *SummaryVec) With(labelValues ...string) Summary {
+	return &observerClient{sv.vec.with(labelValues)}
+}
+
+func (mv *MetricVec) With(labelValues ...string) Metric {
+	return mv.vec.with(labelValues)
+}
+
+// the number of members (the overflow series included, if any)
+func (cv *CounterVec) Len() int   { return cv.vec.len() }
+func (gv *GaugeVec) Len() int     { return gv.vec.len() }
+func (hv *HistogramVec) Len() int { return hv.vec.len() }
+func (sv *SummaryVec) Len() int   { return sv.vec.len() }
+func (mv *MetricVec) Len() int    { return mv.vec.len() }
+
+func newMetricVec(id, name, units string, kind MetricType, labelNames []string, setup func(*metricClient)) *metricVec {
+	return &metricVec{
+		id:         id,
+		name:       name,
+		units:      units,
+		kind:       kind,
+		labelNames: append([]string(nil), labelNames...),
+		setup:      setup,
+		members:    make(map[string]*metricClient),
+		limit:      GetInt("metrics.max.series", 1, 1<<20, defaultMaxSeries),
+	}
+}
+
+// returns the member with the specified label values, creating it if needed;
+// once the vector has "metrics.max.series" members, new label sets go to the overflow series
+func (vec *metricVec) with(values []string) *metricClient {
+	if len(values) != len(vec.labelNames) {
+		warning("metric vector %s expects %d label values, got %d\n", vec.id, len(vec.labelNames), len(values))
+		values = fitLabelValues(values, len(vec.labelNames))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	vec.guard.Lock()
+	defer vec.guard.Unlock()
+
+	if member, found := vec.members[key]; found {
+		return member
+	}
+
+	if len(vec.members) >= vec.limit {
+		if vec.overflow == nil {
+			warning("metric vector %s reached %d series, the rest goes to the overflow series\n", vec.id, vec.limit)
+			overflow := make([]string, len(vec.labelNames))
+			for i := range overflow {
+				overflow[i] = overflowLabel
+			}
+			vec.overflow = vec.create(overflow)
+		}
+		return vec.overflow
+	}
+
+	member := vec.create(values)
+	vec.members[key] = member
+	return member
+}
+
+// note: expects the guard to be locked
+func (vec *metricVec) create(values []string) *metricClient {
+	labels := make([]Label, len(values))
+	for i, value := range values {
+		labels[i] = Label{Name: vec.labelNames[i], Value: value}
+	}
+
+	return createNewMetric(labeledID(vec.id, labels), vec.name, vec.units, vec.kind, func(ms *metricClient) {
+		ms.family = vec.id
+		ms.labels = labels
+		ms.vec = vec
+		if vec.setup != nil {
+			vec.setup(ms)
+		}
+	})
+}
+
+// the member was unregistered, the label values get a new one (see with)
+func (vec *metricVec) forget(ms *metricClient) {
+	vec.guard.Lock()
+	defer vec.guard.Unlock()
+
+	if vec.overflow == ms {
+		vec.overflow = nil
+	}
+	for key, member := range vec.members {
+		if member == ms {
+			delete(vec.members, key)
+			return
+		}
+	}
+}
+
+func (vec *metricVec) len() int {
+	vec.guard.Lock()
+	defer vec.guard.Unlock()
+
+	if vec.overflow != nil {
+		return len(vec.members) + 1
+	}
+	return len(vec.members)
+}
+
+// e.g. http.requests{method="GET",code="200"}
+func labeledID(id string, labels []Label) string {
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = label.Name + "=" + strconv.Quote(label.Value)
+	}
+	return id + "{" + strings.Join(parts, ",") + "}"
+}
+
+func fitLabelValues(values []string, count int) []string {
+	fitted := make([]string, count)
+	copy(fitted, values)
+	return fitted
+}
+
+func sortedOrDefault(values, fallback []float64) []float64 {
+	if len(values) == 0 {
+		values = fallback
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted
+}
@@ -0,0 +1,298 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	idWatchFired   = "base.watch.fired"
+	idWatchCleared = "base.watch.cleared"
+)
+
+// what a watcher compares with its threshold
+type WatchKind byte
+
+const (
+	WatchAbove     WatchKind = iota // the value is above the threshold
+	WatchBelow                      // the value is below the threshold
+	WatchRateAbove                  // the value grows faster than the threshold (per second)
+	WatchRateBelow                  // the value grows slower (or falls faster) than the threshold (per second)
+)
+
+type (
+	WatchCondition struct {
+		Kind      WatchKind
+		Threshold float64
+		// once fired, the watcher clears only when the value (or rate) is back past the threshold by this much
+		Hysteresis float64
+		// the least time between two firings (the watcher may clear in between)
+		Cooldown time.Duration
+	}
+
+	// passed to the callback of a watcher when it fires or clears
+	WatchEvent struct {
+		ID        string // of the metric
+		Condition WatchCondition
+		Fired     bool    // false - cleared
+		Value     float64 // the value (or rate) that fired or cleared the watcher
+		Time      time.Time
+	}
+
+	WatchCallback func(event WatchEvent)
+
+	watcher struct {
+		id        string
+		condition WatchCondition
+		callback  WatchCallback
+		fired     bool
+		firedAt   time.Time
+		previous  *metricSample // the last value seen (see rate)
+		stopped   bool
+	}
+
+	watchFiring struct {
+		entry *watcher
+		event WatchEvent
+	}
+)
+
+var (
+	watchGuard    sync.Mutex
+	watchers      = map[string][]*watcher{} // by metric id
+	watchCounters [2]Counter                // fired, cleared
+)
+
+// calls back when the (numeric) metric meets the condition ("fires") and when it no longer does ("clears");
+// the metric does not have to exist yet. the current value of the metric is checked on every tick of the collector
+// (see "metrics.flush.interval"), whether or not it changed; aggregated metrics are checked against the value
+// of their windows (as they close).
+// every firing and clearing is also logged (on the Logger stream) and counted ("base.watch.fired" and
+// "base.watch.cleared"). returns the func that stops the watcher.
+// note: the callback is called on the metrics sender's goroutine, it should not block
+//
+//	stop, err := base.Watch("queue.depth", base.WatchCondition{Kind: base.WatchAbove, Threshold: 1000,
+//		Hysteresis: 100, Cooldown: time.Minute}, func(event base.WatchEvent) { ... })
+func Watch(metricID string, condition WatchCondition, callback WatchCallback) (func(), error) {
+	if len(metricID) == 0 || callback == nil {
+		return nil, errParamIsNil
+	}
+	if condition.Kind > WatchRateBelow || condition.Hysteresis < 0 || condition.Cooldown < 0 {
+		return nil, errBadWatchCondition
+	}
+
+	entry := &watcher{id: metricID, condition: condition, callback: callback}
+
+	watchGuard.Lock()
+	defer watchGuard.Unlock()
+
+	watchers[metricID] = append(watchers[metricID], entry)
+
+	return func() {
+		watchGuard.Lock()
+		defer watchGuard.Unlock()
+
+		entry.stopped = true
+		list := watchers[metricID]
+		for i, existing := range list {
+			if existing == entry {
+				list = append(list[:i:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(list) > 0 {
+			watchers[metricID] = list
+		} else {
+			delete(watchers, metricID)
+		}
+	}, success
+}
+
+func resetWatchers() {
+	watchGuard.Lock()
+	defer watchGuard.Unlock()
+
+	watchers = map[string][]*watcher{}
+	watchCounters = [2]Counter{}
+}
+
+// "updates" are the ones of the window that closed at "now" (see clientPacket)
+// note: called on the sender's goroutine
+func checkWatchers(updates []clentUpdate, now time.Time) {
+	watchGuard.Lock()
+	ids := make([]string, 0, len(watchers))
+	for id := range watchers {
+		ids = append(ids, id)
+	}
+	watchGuard.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	windows := map[Index]clentUpdate{}
+	for _, update := range updates {
+		if _, aggregated := update.value.(WindowValue); aggregated {
+			windows[update.index] = update
+		}
+	}
+
+	samples := make(map[string]metricSample, len(ids))
+	metricsGuard.Lock()
+	for _, id := range ids {
+		metric := metricsStore.lookup(id)
+		if metric == nil {
+			continue
+		}
+		sample := metricSample{value: metric.liveValue(), time: now}
+		if Aggregation(atomic.LoadInt32(&metric.aggregation)) != AggregateNone {
+			update, found := windows[metric.index]
+			if !found {
+				continue // nothing in the window
+			}
+			sample = metricSample{value: update.value, time: update.time}
+		}
+		samples[id] = sample
+	}
+	metricsGuard.Unlock()
+
+	var firings []watchFiring
+	watchGuard.Lock()
+	for id, sample := range samples {
+		value, numeric := watchValue(sample.value)
+		if !numeric {
+			continue
+		}
+		for _, entry := range watchers[id] {
+			if event, changed := entry.check(value, sample.time); changed {
+				firings = append(firings, watchFiring{entry: entry, event: event})
+			}
+		}
+	}
+	watchGuard.Unlock()
+
+	// note: outside of the guard, the callbacks are free to (un)watch
+	for _, firing := range firings {
+		firing.report()
+	}
+}
+
+func watchValue(value interface{}) (float64, bool) {
+	switch actual := value.(type) {
+	case int64:
+		return float64(actual), true
+	case float64:
+		return actual, true
+	case WindowValue:
+		return actual.Value, true
+	default:
+		return 0, false
+	}
+}
+
+// note: expects watchGuard to be locked
+func (entry *watcher) check(value float64, now time.Time) (WatchEvent, bool) {
+	condition := entry.condition
+	measured := value
+
+	if condition.Kind == WatchRateAbove || condition.Kind == WatchRateBelow {
+		previous := entry.previous
+		entry.previous = &metricSample{value: value, time: now}
+		if previous == nil {
+			return WatchEvent{}, false
+		}
+		elapsed := now.Sub(previous.time).Seconds()
+		if elapsed <= 0 {
+			return WatchEvent{}, false
+		}
+		measured = (value - previous.value.(float64)) / elapsed
+	}
+
+	var met, clear bool
+	switch condition.Kind {
+	case WatchAbove, WatchRateAbove:
+		met = measured > condition.Threshold
+		clear = measured < condition.Threshold-condition.Hysteresis
+	default:
+		met = measured < condition.Threshold
+		clear = measured > condition.Threshold+condition.Hysteresis
+	}
+
+	switch {
+	case !entry.fired && met:
+		if !entry.firedAt.IsZero() && now.Sub(entry.firedAt) < condition.Cooldown {
+			return WatchEvent{}, false
+		}
+		entry.fired = true
+		entry.firedAt = now
+	case entry.fired && clear:
+		entry.fired = false
+	default:
+		return WatchEvent{}, false
+	}
+
+	return WatchEvent{ID: entry.id, Condition: condition, Fired: entry.fired, Value: measured, Time: now}, true
+}
+
+func (firing watchFiring) report() {
+	event := firing.event
+	fields := log.Fields{
+		"watch.metric":    event.ID,
+		"watch.condition": event.Condition.Kind.String(),
+		"watch.threshold": event.Condition.Threshold,
+		"watch.value":     event.Value,
+	}
+	if event.Fired {
+		GetLogger().WithFields(fields).Warnf("metric watcher fired: %s %s %v (%v)",
+			event.ID, event.Condition.Kind, event.Condition.Threshold, event.Value)
+	} else {
+		GetLogger().WithFields(fields).Infof("metric watcher cleared: %s %s %v (%v)",
+			event.ID, event.Condition.Kind, event.Condition.Threshold, event.Value)
+	}
+
+	getWatchCounter(event.Fired).Add(1)
+
+	watchGuard.Lock()
+	stopped := firing.entry.stopped
+	watchGuard.Unlock()
+
+	if !stopped {
+		firing.entry.callback(event)
+	}
+}
+
+func getWatchCounter(fired bool) Counter {
+	watchGuard.Lock()
+	defer watchGuard.Unlock()
+
+	slot, id, name := 1, idWatchCleared, "Metric watchers cleared"
+	if fired {
+		slot, id, name = 0, idWatchFired, "Metric watchers fired"
+	}
+	if watchCounters[slot] == nil {
+		watchCounters[slot] = CreateNewCounter(id, name, "count")
+	}
+	return watchCounters[slot]
+}
+
+func (kind WatchKind) String() string {
+	switch kind {
+	case WatchAbove:
+		return "above"
+	case WatchBelow:
+		return "below"
+	case WatchRateAbove:
+		return "rate.above"
+	case WatchRateBelow:
+		return "rate.below"
+	default:
+		return "unknown"
+	}
+}
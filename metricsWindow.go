@@ -0,0 +1,174 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultFlushInterval = time.Second
+)
+
+// how the (numeric) updates of a metric are aggregated between the flushes of the collector
+type Aggregation byte
+
+const (
+	AggregateNone Aggregation = iota // the last value is sent as it is (the default)
+	AggregateLast                    // the rest send a WindowValue
+	AggregateMin
+	AggregateMax
+	AggregateSum
+	AggregateCount
+	AggregateMean
+)
+
+type (
+	// the statistics of the updates posted within a window (between two flushes of the collector)
+	WindowValue struct {
+		Mode  Aggregation
+		Value float64 // as per the mode
+		Count uint64
+		Min   float64
+		Max   float64
+		Sum   float64
+		Start time.Time
+		End   time.Time
+	}
+
+	// what the collector keeps for an aggregated metric
+	window struct {
+		mode  Aggregation
+		count uint64
+		last  float64
+		min   float64
+		max   float64
+		sum   float64
+	}
+
+	// implemented by all the metrics (see createNewMetric)
+	metricHolder interface {
+		client() *metricClient
+	}
+)
+
+// makes the collector aggregate the updates of the metric (a Metric, Counter or Gauge);
+// string updates are not aggregated, histograms and summaries are aggregated already
+func SetAggregation(metric interface{}, mode Aggregation) error {
+	if metric == nil {
+		return errParamIsNil
+	}
+	holder, ok := metric.(metricHolder)
+	if !ok {
+		return errNotAMetric
+	}
+	if holder.client() == nil {
+		return errParamIsNil
+	}
+	if mode > AggregateMean {
+		return errBadAggregation
+	}
+
+	atomic.StoreInt32(&holder.client().aggregation, int32(mode))
+	return success
+}
+
+func (ms *metricClient) client() *metricClient {
+	return ms
+}
+
+// how often the collector flushes ("metrics.flush.interval")
+func flushInterval() time.Duration {
+	return GetDuration("metrics.flush.interval", 10*time.Millisecond, time.Hour, defaultFlushInterval)
+}
+
+// note: called on the collector's goroutine
+func aggregate(windows map[Index]*window, update clentUpdate) bool {
+	var value float64
+	switch actual := update.value.(type) {
+	case int64:
+		value = float64(actual)
+	case float64:
+		value = actual
+	default:
+		return false
+	}
+
+	entry := windows[update.index]
+	if entry == nil {
+		entry = &window{mode: update.aggregation, min: math.Inf(+1), max: math.Inf(-1)}
+		windows[update.index] = entry
+	}
+
+	entry.count++
+	entry.last = value
+	entry.sum += value
+	entry.min = math.Min(entry.min, value)
+	entry.max = math.Max(entry.max, value)
+	return true
+}
+
+// turns the windows into updates, the windows start over
+// note: called on the collector's goroutine
+func closeWindows(windows map[Index]*window, updates map[Index]clentUpdate, start, end time.Time) {
+	for index, entry := range windows {
+		updates[index] = clentUpdate{index: index, value: entry.value(start, end), time: end}
+		delete(windows, index)
+	}
+}
+
+func (entry *window) value(start, end time.Time) WindowValue {
+	value := WindowValue{
+		Mode:  entry.mode,
+		Count: entry.count,
+		Min:   entry.min,
+		Max:   entry.max,
+		Sum:   entry.sum,
+		Start: start,
+		End:   end,
+	}
+
+	switch entry.mode {
+	case AggregateMin:
+		value.Value = entry.min
+	case AggregateMax:
+		value.Value = entry.max
+	case AggregateSum:
+		value.Value = entry.sum
+	case AggregateCount:
+		value.Value = float64(entry.count)
+	case AggregateMean:
+		value.Value = entry.sum / float64(entry.count)
+	default:
+		value.Value = entry.last
+	}
+	return value
+}
+
+func (value WindowValue) String() string {
+	return sprintf("%s=%v count=%d min=%v max=%v sum=%v window=%v",
+		value.Mode, value.Value, value.Count, value.Min, value.Max, value.Sum, value.End.Sub(value.Start))
+}
+
+func (mode Aggregation) String() string {
+	switch mode {
+	case AggregateLast:
+		return "last"
+	case AggregateMin:
+		return "min"
+	case AggregateMax:
+		return "max"
+	case AggregateSum:
+		return "sum"
+	case AggregateCount:
+		return "count"
+	case AggregateMean:
+		return "mean"
+	default:
+		return "none"
+	}
+}
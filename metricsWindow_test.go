@@ -0,0 +1,82 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+func TestSetAggregation(t *testing.T) {
+	basetest.New(t)
+
+	gauge := base.CreateNewGauge("checked", "Checked", "count")
+	if err := base.SetAggregation(gauge, base.AggregateMean); err != nil {
+		t.Errorf("failed to set the aggregation: %v", err)
+	}
+	if err := base.SetAggregation(gauge, base.AggregateMean+1); err == nil {
+		t.Errorf("an unknown mode was accepted")
+	}
+	missing := base.SetAggregation(nil, base.AggregateMax)
+	if missing == nil {
+		t.Errorf("nil was accepted")
+	}
+	if err := base.SetAggregation("checked", base.AggregateMax); err == nil || err == missing {
+		t.Errorf("a string (not a metric) returned (%v)", err)
+	}
+}
+
+// the updates posted between two flushes are sent as one value
+func TestAggregatedWindow(t *testing.T) {
+	kit := basetest.New(t)
+
+	gauge := base.CreateNewGauge("peak", "Peak", "count")
+	base.SetAggregation(gauge, base.AggregateMax)
+	gauge.Set(0)
+	if !kit.WaitFor(func() bool { _, found := kit.Metric("peak"); return found }, kit.Timeout) {
+		t.Fatalf("nothing received")
+	}
+
+	// right after a flush, hence all in the same window
+	gauge.Set(3)
+	gauge.Set(9)
+	gauge.Set(1)
+
+	expected := "max=9 count=3 min=1 max=9 sum=13 "
+	if !kit.WaitFor(func() bool { last, _ := kit.Metric("peak"); return strings.HasPrefix(last, expected) }, kit.Timeout) {
+		t.Errorf("expected (%s...), received %q", expected, kit.MetricValues("peak"))
+	}
+}
+
+// an aggregated metric is sent once per flush ("metrics.flush.interval", 1s by default), however often it is updated
+func TestFlushInterval(t *testing.T) {
+	kit := basetest.New(t)
+
+	busy := base.CreateNewCounter("busy", "Busy", "count")
+	base.SetAggregation(busy, base.AggregateCount)
+	for started := time.Now(); time.Since(started) < 2500*time.Millisecond; {
+		busy.Add(1)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !kit.WaitFor(func() bool { return len(kit.MetricValues("busy")) >= 3 }, kit.Timeout) {
+		t.Fatalf("expected a value per flush, received %q", kit.MetricValues("busy"))
+	}
+
+	values := kit.MetricValues("busy")
+	if len(values) > 4 {
+		t.Errorf("expected about a value per second, received %q", values)
+	}
+	for _, value := range values[1 : len(values)-1] { // the first and the last windows are partial
+		part := value[strings.LastIndex(value, "window=")+len("window="):]
+		window, err := time.ParseDuration(part)
+		if err != nil || window < 900*time.Millisecond || window > 1100*time.Millisecond {
+			t.Errorf("unexpected window of (%s): %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a metric updated with the same value over and over is not idle
+func TestRepeatedValueKeepsMetricAlive(t *testing.T) {
+	ttl := 1500 * time.Millisecond
+	metric := createNewMetric("expiry.repeated", "Repeated", "count", TypeMetric, func(ms *metricClient) {
+		ms.ttl = ttl
+	})
+	defer metric.Unregister()
+
+	for started := time.Now(); time.Since(started) < 2*ttl+flushInterval(); {
+		metric.Update("same") // it would bring an expired metric back, hence the check ahead of the next one
+		time.Sleep(100 * time.Millisecond)
+		if state := atomic.LoadInt32(&metric.state); state != metricRegistered {
+			t.Fatalf("the metric expired while being updated (after %v)", time.Since(started))
+		}
+	}
+
+	deadline := time.Now().Add(ttl + 2*flushInterval())
+	for atomic.LoadInt32(&metric.state) != metricExpired {
+		if time.Now().After(deadline) {
+			t.Fatalf("the metric did not expire once the updates stopped")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// the values flushed never go back, the last one is the total
+func TestConcurrentCounterAdds(t *testing.T) {
+	const (
+		writers = 8
+		adds    = 5000
+	)
+	counter := createNewMetric("race.counter", "Adds", "count", TypeCounter, nil)
+	defer counter.Unregister()
+
+	var guard sync.Mutex
+	var flushed []int64
+	remove := addMetricsListener(func(updates []clentUpdate) {
+		guard.Lock()
+		defer guard.Unlock()
+		for _, update := range updates {
+			if value, ok := update.value.(int64); ok && update.index == counter.currentIndex() {
+				flushed = append(flushed, value)
+			}
+		}
+	})
+	defer remove()
+
+	var writing sync.WaitGroup
+	stop := make(chan bool)
+	go func() {
+		// plenty of windows closing while the counter is added to
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				flushMetrics(time.Second)
+			}
+		}
+	}()
+	for i := 0; i < writers; i++ {
+		writing.Add(1)
+		go func() {
+			defer writing.Done()
+			for j := 0; j < adds; j++ {
+				counter.Add(1)
+			}
+		}()
+	}
+	writing.Wait()
+	close(stop)
+	if err := flushMetrics(5 * time.Second); err != success {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	guard.Lock()
+	defer guard.Unlock()
+	for i := 1; i < len(flushed); i++ {
+		if flushed[i] < flushed[i-1] {
+			t.Errorf("the counter went back from (%d) to (%d)", flushed[i-1], flushed[i])
+		}
+	}
+	if len(flushed) == 0 || flushed[len(flushed)-1] != writers*adds {
+		t.Errorf("the last value flushed is not the total (%d): %v", writers*adds, flushed[len(flushed)-1:])
+	}
+}
+
+// the update of an earlier add coming in after the update of a later one
+func TestLateCounterUpdate(t *testing.T) {
+	counter := createNewMetric("late.counter", "Adds", "count", TypeCounter, nil)
+	defer counter.Unregister()
+
+	latest := make(chan int64, 16)
+	remove := addMetricsListener(func(updates []clentUpdate) {
+		for _, update := range updates {
+			if value, ok := update.value.(int64); ok && update.index == counter.currentIndex() {
+				latest <- value
+			}
+		}
+	})
+	defer remove()
+
+	counter.Add(1)
+	counter.Add(1)
+	counter.send(clentUpdate{index: counter.currentIndex(), value: int64(1), time: time.Now()}) // the first add, late
+	if err := flushMetrics(5 * time.Second); err != success {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	var value int64
+	for len(latest) > 0 {
+		value = <-latest
+	}
+	if value != 2 {
+		t.Errorf("flushed (%d), expected (2)", value)
+	}
+}
+
+// of two concurrent posts, the one stored last is the one flushed (the next post is compared with it)
+func TestLatePostUpdate(t *testing.T) {
+	metric := createNewMetric("late.post", "Posts", "", TypeMetric, nil)
+	defer metric.Unregister()
+
+	latest := make(chan interface{}, 16)
+	remove := addMetricsListener(func(updates []clentUpdate) {
+		for _, update := range updates {
+			if update.index == metric.currentIndex() {
+				latest <- update.value
+			}
+		}
+	})
+	defer remove()
+
+	metric.Post("stored")
+	metric.send(clentUpdate{index: metric.currentIndex(), value: "overtaken", time: time.Now()}) // stored before "stored", late
+	if err := flushMetrics(5 * time.Second); err != success {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	var value interface{}
+	for len(latest) > 0 {
+		value = <-latest
+	}
+	if value != "stored" {
+		t.Errorf("flushed (%v), expected (stored)", value)
+	}
+}
+
+func BenchmarkPost(b *testing.B) {
+	metric := createNewMetric("bench.post", "Posts", "count", TypeMetric, nil)
+	defer metric.Unregister()
+
+	values := []string{"idle", "busy", "draining", "stopped"}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			metric.Post(values[i%len(values)])
+		}
+	})
+}
+
+func BenchmarkCounterAddParallel(b *testing.B) {
+	counter := createNewMetric("bench.counter", "Adds", "count", TypeCounter, nil)
+	defer counter.Unregister()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			counter.Add(1)
+		}
+	})
+}
+
+// the restored value is not an increment, an unregistered counter is no longer checkpointed but keeps its value
+func TestRestoredCounter(t *testing.T) {
+	persistGuard.Lock()
+	persistLoaded = true
+	persistFilename = filepath.Join(t.TempDir(), "counters.state")
+	persistValues["persist.restored"] = 500
+	persistGuard.Unlock()
+	defer resetPersistence()
+
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer agent.Close()
+	if err := StartStatsD(agent.LocalAddr().String()); err != success {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer StopStatsD()
+
+	counter := CreatePersistentCounter("persist.restored", "Restored", "count").(*metricClient)
+	if value := counter.current().value; value != int64(500) || atomic.LoadInt64(&counter.counter) != 500 {
+		t.Errorf("restored (%v), expected (500)", value)
+	}
+	counter.Add(3)
+
+	var lines []string
+	buffer := make([]byte, 65536)
+	agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !containsPrefix(lines, "persist.restored:3|c") {
+		n, _, err := agent.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("no increment received: %v, received: %q", err, lines)
+		}
+		lines = append(lines, strings.Split(string(buffer[:n]), "\n")...)
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "persist.restored:") && !strings.HasPrefix(line, "persist.restored:3|c") {
+			t.Errorf("unexpected increment: %s", line)
+		}
+	}
+
+	counter.Unregister()
+	counter.Add(10) // ignored
+	if err := CheckpointCounters(); err != success {
+		t.Fatalf("checkpoint failed: %v", err)
+	}
+	persistGuard.Lock()
+	_, persisted := persistCounters["persist.restored"]
+	written := persistWritten["persist.restored"]
+	persistGuard.Unlock()
+	if persisted || written != 503 {
+		t.Errorf("the unregistered counter is still persisted (%v), checkpointed (%d)", persisted, written)
+	}
+
+	again := CreatePersistentCounter("persist.restored", "Restored", "count").(*metricClient)
+	defer again.Unregister()
+	if value := atomic.LoadInt64(&again.counter); value != 503 {
+		t.Errorf("created again with (%d), expected (503)", value)
+	}
+}
+
+func containsPrefix(lines []string, prefix string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+func TestCreateWithAnotherKind(t *testing.T) {
+	kit := basetest.New(t)
+
+	base.CreateNewCounter("shared", "Shared", "count").Add(5)
+	gauge := base.CreateNewGauge("shared", "Shared", "count")
+	gauge.Set(7)
+
+	kit.AssertMetric("shared", "5")
+	states := base.SnapshotMetrics("shared")
+	if len(states) != 1 || states[0].Type != base.TypeCounter || states[0].Value != int64(5) {
+		t.Errorf("the counter was affected by the gauge: %+v", states)
+	}
+}
+
+func TestUpdateWithUncomparableValue(t *testing.T) {
+	kit := basetest.New(t)
+
+	metric := base.CreateNewMetric("latency", "Latency", "seconds")
+	value := base.HistogramValue{Count: 1, Sum: 0.5, Buckets: []base.Bucket{{UpperBound: 1, Count: 1}}}
+	metric.Update(value)
+	metric.Update(value) // must not panic comparing the values
+
+	kit.AssertMetric("latency", value.String())
+}
+
+// the metrics store used to panic creating the 100th metric
+func TestManyMetrics(t *testing.T) {
+	kit := basetest.New(t)
+
+	for i := 1; i <= 150; i++ {
+		base.CreateNewCounter("many."+strconv.Itoa(i), "Many", "count").Add(int64(i))
+	}
+	kit.AssertMetric("many.100", "100")
+	kit.AssertMetric("many.150", "150")
+}
+
+// the index of an unregistered metric is given to the next one, the receiver tells them apart
+func TestUnregisteredMetricIndexReused(t *testing.T) {
+	kit := basetest.New(t)
+
+	gone := base.CreateNewMetric("gone", "Gone", "")
+	gone.Update("old")
+	kit.AssertMetric("gone", "old")
+	gone.Unregister()
+	if !kit.WaitFor(func() bool { return kit.Removed("gone") }, kit.Timeout) {
+		t.Fatalf("the receiver was not told about the removal")
+	}
+
+	base.CreateNewMetric("next", "Next", "").Update("new")
+	kit.AssertMetric("next", "new")
+	if values := kit.MetricValues("gone"); len(values) != 1 {
+		t.Errorf("the metric that took the index was received as (gone): %q", values)
+	}
+	if states := base.SnapshotMetrics("gone"); len(states) != 0 {
+		t.Errorf("the unregistered metric is still there: %+v", states)
+	}
+}
+
+// a counter that stops growing is seen as such, though there are no updates to flush
+func TestRateWatcherSeesStall(t *testing.T) {
+	basetest.New(t)
+
+	events := make(chan base.WatchEvent, 4)
+	stop, err := base.Watch("jobs.done", base.WatchCondition{Kind: base.WatchRateBelow, Threshold: 1}, func(event base.WatchEvent) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatalf("failed to watch: %v", err)
+	}
+	defer stop()
+
+	base.CreateNewCounter("jobs.done", "Jobs done", "count").Add(100)
+
+	select {
+	case event := <-events:
+		if !event.Fired || event.Value != 0 {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the watcher did not fire")
+	}
+}
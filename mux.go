@@ -15,6 +15,7 @@ import (
 	"os/user"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,6 +31,26 @@ type (
 	Fingerprint = map[string]interface{}
 )
 
+var (
+	fingerprintGuard  sync.Mutex
+	fingerprintExtras = make(Fingerprint)
+)
+
+// adds (or replaces) a fact that will be included in the fingerprint sent on every (re-)connect
+func SetFingerprintFact(key string, value interface{}) {
+	fingerprintGuard.Lock()
+	defer fingerprintGuard.Unlock()
+
+	fingerprintExtras[key] = value
+}
+
+func resetFingerprint() {
+	fingerprintGuard.Lock()
+	defer fingerprintGuard.Unlock()
+
+	fingerprintExtras = make(Fingerprint)
+}
+
 func construct(id int, p Stream) Stream {
 	l := len(p)
 	result := make(Stream, prefixSize+l)
@@ -103,6 +124,12 @@ func assembleFingerprint() Stream {
 		facts["description"] = value
 	}
 
+	fingerprintGuard.Lock()
+	for key, value := range fingerprintExtras {
+		facts[key] = value
+	}
+	fingerprintGuard.Unlock()
+
 	// var mem runtime.MemStats
 	// runtime.ReadMemStats(&mem)
 
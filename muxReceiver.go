@@ -6,6 +6,7 @@ package base
 
 import (
 	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,10 +21,24 @@ type (
 	}
 
 	NewConnection func(props map[string]interface{}) Connection
+
+	ReceiverOption func(*muxReceiver)
 )
 
+// makes the receiver publish its port in the ports file (see DiscoverPorts), so the apps can find it;
+// the file is written atomically, locked against other receivers and removed when the receiver is closed.
+// if the filename is empty, port.json in the runtime directory (see RuntimeDir) is used
+func PublishPort(filename string) ReceiverOption {
+	return func(receiver *muxReceiver) {
+		if len(filename) == 0 {
+			filename = filepath.Join(RuntimeDir(), defaultPortsFilename)
+		}
+		receiver.portsFilename = filename
+	}
+}
+
 // Creates a new "receiver", if specified port is set to  0 (zero), a random port will be selected (and returned)
-func CreateReceiver(port int, maker NewConnection) (int, error) {
+func CreateReceiver(port int, maker NewConnection, options ...ReceiverOption) (int, error) {
 	if port < 0 {
 		log.Errorf("port number cannot be negative")
 		return port, errNegativePortNumber
@@ -58,6 +73,18 @@ func CreateReceiver(port int, maker NewConnection) (int, error) {
 		listener: l,
 	}
 
+	for _, option := range options {
+		option(&receiver)
+	}
+
+	if len(receiver.portsFilename) > 0 {
+		if err := publishPort(receiver.portsFilename, port); err != success {
+			GetLogger().WithError(err).Errorf("failed to publish port %d in (%s)", port, receiver.portsFilename)
+			l.Close()
+			return 0, err
+		}
+	}
+
 	{
 		muxGuard.Lock()
 		muxReceivers = append(muxReceivers, &receiver)
@@ -66,12 +93,16 @@ func CreateReceiver(port int, maker NewConnection) (int, error) {
 
 	go func(receiver *muxReceiver) {
 		defer l.Close()
+		defer receiver.unpublish()
 		log := GetLogger().WithFields(map[string]interface{}{"addr.local": l.Addr().String(), "port": port})
 
 		for {
 			log.Tracef("waiting for incoming connection")
 			if conn, err := l.Accept(); err != success {
 				log.WithError(err).Errorf("Accept failed")
+				if netErr, ok := err.(net.Error); !ok || !netErr.Temporary() {
+					return // e.g. the listener was closed
+				}
 			} else {
 				log.Tracef("got new connection from: %v", conn.RemoteAddr().String())
 				go muxReceiverThread(log, conn, receiver)
@@ -84,10 +115,35 @@ func CreateReceiver(port int, maker NewConnection) (int, error) {
 
 }
 
+// serves an already established connection (e.g. one end of net.Pipe) the same way the receiver does,
+// returns when the connection is closed
+func ServeConn(conn net.Conn, maker NewConnection) error {
+	if conn == nil || maker == nil {
+		return errParamIsNil
+	}
+
+	log := GetLogger().WithField("addr.local", conn.LocalAddr().String())
+	muxReceiverThread(log, conn, &muxReceiver{maker: maker})
+	return success
+}
+
 type muxReceiver struct {
 	maker    NewConnection
 	port     int
 	listener net.Listener
+
+	portsFilename string // where the port is published (if at all)
+	unpublished   sync.Once
+}
+
+func (receiver *muxReceiver) unpublish() {
+	if len(receiver.portsFilename) > 0 {
+		receiver.unpublished.Do(func() {
+			if err := unpublishPort(receiver.portsFilename); err != success {
+				GetLogger().WithError(err).Warningf("failed to remove ports file (%s)", receiver.portsFilename)
+			}
+		})
+	}
 }
 
 var (
@@ -98,11 +154,11 @@ var (
 func CloseReceiver(port int) error {
 
 	var receiver *muxReceiver
-	var index int
 
 	muxGuard.Lock()
-	for index, receiver = range muxReceivers {
-		if receiver != nil && receiver.port == port {
+	for index, entry := range muxReceivers {
+		if entry != nil && entry.port == port {
+			receiver = entry
 			muxReceivers = append(muxReceivers[:index], muxReceivers[index+1:]...)
 			break
 		}
@@ -115,10 +171,28 @@ func CloseReceiver(port int) error {
 	}
 
 	err := receiver.listener.Close()
+	receiver.unpublish()
 
 	return err
 }
 
+// closes all the receivers (e.g. on shutdown), which also removes their ports files
+func CloseAllReceivers() error {
+	muxGuard.Lock()
+	receivers := muxReceivers
+	muxReceivers = nil
+	muxGuard.Unlock()
+
+	var result error
+	for _, receiver := range receivers {
+		if err := receiver.listener.Close(); err != success && result == success {
+			result = err
+		}
+		receiver.unpublish()
+	}
+	return result
+}
+
 // ...
 // this func takes "chan" as input to allow multiplexing of many stream on the same chan
 // you can differenciate between different messages using "id" that the caller specifies and it will be set in Pack.ID
@@ -186,6 +260,7 @@ func muxReceiverThread(log *log.Entry, conn net.Conn, receiver *muxReceiver) {
 	buf := make([]byte, msgSize)
 	var total uint64
 	var connection Connection
+	var pending Stream // received data that does not make a complete packet (yet)
 
 	for {
 
@@ -200,56 +275,46 @@ func muxReceiverThread(log *log.Entry, conn net.Conn, receiver *muxReceiver) {
 		total += uint64(nread)
 		log.Tracef("received %v bytes", total)
 
-		buffer := buf[:nread]
+		pending = append(pending, buf[:nread]...)
 
-		for {
-			id, payload, remainder, err := deconstruct(buffer)
-			if err == success {
-				if id == idFinderPrint {
-					fp, err := extractFingerprint(payload)
-					if err != success {
-						log.WithError(err).Errorf("failed to get the fingerprint")
-						// todo: ???????????
-					}
-
-					fp["remote.addr"] = conn.RemoteAddr().String()
-
-					if connection == nil {
-						connection = receiver.maker(fp)
-					} else {
-						connection.OnNewMessage(id, payload) // warning: calling user's code on the receiving thread
-					}
-				} else {
-					if connection != nil {
-						connection.OnNewMessage(id, payload) // warning: calling user's code on the receiving thread
-					} else {
-						log.Warning("a message with no connection")
-					}
-				}
-			} else if err == errIncompleteData {
-				log.Warning("failed to receive complete package - need to get more")
-			} else {
+		for len(pending) > 0 {
+			id, payload, remainder, err := deconstruct(pending)
+			if err == errIncompleteData {
+				break // need to get more
+			} else if err != success {
 				log.WithError(err).Errorf("failed to deconstruct incoming data")
-			}
-
-			if remainder > 0 {
-				buffer = buffer[len(buffer)-remainder:]
-			} else {
 				break
 			}
-		}
 
-		/*
-			} else {
+			if id == idFinderPrint {
+				fp, err := extractFingerprint(payload)
+				if err != success {
+					log.WithError(err).Errorf("failed to get the fingerprint")
+					// todo: ???????????
+					fp = make(Fingerprint)
+				}
 
-					connection.OnNewMessage(id, payload)
-					for remainder > 0 {
-						buffer = buffer[len(buffer)-remainder:]
-						goto Processing
-					}
+				fp["remote.addr"] = conn.RemoteAddr().String()
+
+				if connection == nil {
+					connection = receiver.maker(fp)
+				} else {
+					connection.OnNewMessage(id, payload) // warning: calling user's code on the receiving thread
+				}
+			} else {
+				if connection != nil {
+					connection.OnNewMessage(id, payload) // warning: calling user's code on the receiving thread
+				} else {
+					log.Warning("a message with no connection")
 				}
-		*/
+			}
 
+			pending = pending[len(pending)-remainder:]
+		}
+
+		if len(pending) == 0 {
+			pending = nil // let the (possibly large) buffer go
+		}
 	}
 
 	if connection != nil {
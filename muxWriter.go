@@ -5,6 +5,7 @@
 package base
 
 import (
+	"encoding/json"
 	"io"
 	"net"
 	"sync"
@@ -13,6 +14,9 @@ import (
 
 const (
 	copyPayloadBuffers = true
+
+	// the ids of the named streams are allocated from here on, well above the ones the apps pick (e.g. GetPipe(User+n))
+	firstNamedStream = 1 << 24
 )
 
 type (
@@ -21,9 +25,51 @@ type (
 	MuxWriter interface {
 		// io.Writer
 		NewWriter(int) (io.Writer, error)
+
+		// waits (up to the specified timeout) till all the accumulated data is sent
+		Flush(time.Duration) error
+
+		// opens a stream with an allocated id; the stream is announced to the receiver (see StreamInfo)
+		OpenStream(name, contentType string) (io.WriteCloser, error)
 	}
+
+	// establishes the connection to the receiver listening on the specified port
+	Dialer func(port int) (net.Conn, error)
 )
 
+var (
+	dialerGuard sync.Mutex
+	dialer      Dialer = dialPort
+)
+
+// replaces the dialer used by the mux writers (e.g. with an in-memory transport), nil restores the default one;
+// returns the previously used dialer
+func SetDialer(d Dialer) Dialer {
+	if d == nil {
+		d = dialPort
+	}
+
+	dialerGuard.Lock()
+	defer dialerGuard.Unlock()
+
+	previous := dialer
+	dialer = d
+	return previous
+}
+
+func dial(port int) (net.Conn, error) {
+	dialerGuard.Lock()
+	d := dialer
+	dialerGuard.Unlock()
+
+	return d(port)
+}
+
+func dialPort(port int) (net.Conn, error) {
+	domain, address := getDomainAndAddress(port)
+	return net.DialTimeout(domain, address, timeoutDial)
+}
+
 type single struct {
 	id  int
 	mux *muxWriter
@@ -43,6 +89,12 @@ func (s *single) closedWrite(p []byte) (int, error) {
 	return 0, errStreamIsClosed
 }
 
+// closes the stream: the receiver is notified with an empty packet, which marks the end of the stream
+func (s *single) Close() error {
+	s.mux.closeWriter(s)
+	return success
+}
+
 func (s *single) close() {
 	// mark as invalid !!!!
 	s.write = s.closedWrite
@@ -55,14 +107,30 @@ type muxWriter struct {
 	packets []Stream
 	writers map[int]*single
 	channel chan int
+	redial  chan bool // makes the sender drop the connection and dial (the new port) again, closed along with the mux
+	sending Stream    // the packet taken off the queue, but not yet written
+	closed  bool
+
+	// the metrics written while disconnected are dropped, the snapshot sent on connect replaces them (see sendMetricsSnapshot)
+	connected bool
+
+	streams       map[string]int // ids of the named streams
+	named         map[int]bool   // the same ids, reserved for the named streams (see NewWriter)
+	announcements map[int]Stream // announcements of the open named streams, (re-)sent on every connect
+	vacantStream  int
 }
 
 func CreateMuxWriter(port int) MuxWriter {
 	mux := muxWriter{
-		port:    port,
-		packets: make([]Stream, 0, 100),
-		writers: make(map[int]*single),
-		channel: make(chan int, 6),
+		port:          port,
+		packets:       make([]Stream, 0, 100),
+		writers:       make(map[int]*single),
+		channel:       make(chan int, 6),
+		redial:        make(chan bool, 1),
+		streams:       make(map[string]int),
+		named:         make(map[int]bool),
+		announcements: make(map[int]Stream),
+		vacantStream:  firstNamedStream,
 	}
 
 	go mux.sender()
@@ -78,10 +146,18 @@ func (mux *muxWriter) NewWriter(id int) (io.Writer, error) {
 	mux.lock()
 	defer mux.unlock()
 
+	if mux.named[id] {
+		return nil, errStreamIdReserved
+	}
+	return mux.newWriter(id), success
+}
+
+// note: expects the guard to be locked
+func (mux *muxWriter) newWriter(id int) *single {
 	if mux.writers == nil {
 		mux.writers = make(map[int]*single)
 	} else if writer, found := mux.writers[id]; found {
-		return writer, success
+		return writer
 	}
 
 	writer := single{
@@ -91,7 +167,57 @@ func (mux *muxWriter) NewWriter(id int) (io.Writer, error) {
 	writer.write = writer.activeWrite
 
 	mux.writers[id] = &writer
-	return &writer, success
+	return &writer
+}
+
+func (mux *muxWriter) OpenStream(name, contentType string) (io.WriteCloser, error) {
+	if len(name) == 0 {
+		return nil, errEmptyStreamName
+	}
+
+	mux.lock()
+	defer mux.unlock()
+
+	id, found := mux.streams[name]
+	if !found {
+		// skip the ids that are already taken by (unnamed) writers
+		for _, taken := mux.writers[mux.vacantStream]; taken; _, taken = mux.writers[mux.vacantStream] {
+			mux.vacantStream++
+		}
+		id = mux.vacantStream
+		mux.vacantStream++
+		mux.streams[name] = id
+		mux.named[id] = true
+	}
+
+	data, err := json.Marshal(StreamInfo{ID: id, Name: name, ContentType: contentType})
+	if err != success {
+		return nil, err
+	}
+
+	announcement := construct(Streams, data)
+	mux.announcements[id] = announcement
+	if !mux.closed {
+		mux.packets = append(mux.packets, announcement)
+		mux.signal(Streams)
+	}
+
+	return mux.newWriter(id), success
+}
+
+func (mux *muxWriter) closeWriter(writer *single) {
+	mux.lock()
+	open := mux.writers[writer.id] == writer
+	if open {
+		delete(mux.writers, writer.id)
+		delete(mux.announcements, writer.id)
+	}
+	mux.unlock()
+
+	if open {
+		mux.add(writer.id, construct(writer.id, nil))
+		writer.close()
+	}
 }
 
 func (mux *muxWriter) write(id int, p []byte) (n int, err error) {
@@ -104,11 +230,34 @@ func (mux *muxWriter) write(id int, p []byte) (n int, err error) {
 
 func (mux *muxWriter) add(id int, what Stream) {
 	mux.lock()
+	defer mux.unlock()
+
+	if mux.closed || (id == Metrics && !mux.connected) {
+		return
+	}
+
 	mux.packets = append(mux.packets, what)
-	mux.unlock()
 	mux.signal(id)
 }
 
+// on connect, the metrics still queued (e.g. of failed writes) are dropped, the snapshot comes instead
+func (mux *muxWriter) setConnected(connected bool) {
+	mux.lock()
+	defer mux.unlock()
+
+	mux.connected = connected
+	if !connected {
+		return
+	}
+	packets := mux.packets[:0]
+	for _, packet := range mux.packets {
+		if id, _, _, err := deconstruct(packet); err != success || id != Metrics {
+			packets = append(packets, packet)
+		}
+	}
+	mux.packets = packets
+}
+
 func (mux *muxWriter) signal(id int) {
 	if len(mux.channel) < 3 {
 		mux.channel <- id
@@ -131,11 +280,85 @@ func (mux *muxWriter) Close() error {
 		writer.close()
 	}
 
+	if !mux.closed {
+		mux.closed = true
+		close(mux.channel) // this should terminate the sender
+		close(mux.redial)
+	}
+
 	return nil
 }
 
+// points the mux to another port: the sender reconnects, the writers (and the named streams) stay as they are
+func (mux *muxWriter) retarget(port int) {
+	mux.lock()
+	defer mux.unlock()
+
+	if mux.closed || mux.port == port {
+		return
+	}
+	mux.port = port
+	select {
+	case mux.redial <- true:
+	default: // it is about to redial anyway
+	}
+}
+
+func (mux *muxWriter) currentPort() int {
+	mux.lock()
+	defer mux.unlock()
+
+	return mux.port
+}
+
+func (mux *muxWriter) isClosed() bool {
+	mux.lock()
+	defer mux.unlock()
+
+	return mux.closed
+}
+
+// waits for the packets written so far only, what is written meanwhile (e.g. the logs of a busy app) does not hold it up;
+// the packets are told apart by their buffers (a packet that failed to be written is queued again as it is)
+func (mux *muxWriter) Flush(timeout time.Duration) error {
+	mux.lock()
+	pending := map[*byte]bool{packetKey(mux.sending): true}
+	for _, packet := range mux.packets {
+		pending[packetKey(packet)] = true
+	}
+	delete(pending, nil)
+	mux.unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		mux.lock()
+		done := !pending[packetKey(mux.sending)]
+		for _, packet := range mux.packets {
+			if pending[packetKey(packet)] {
+				done = false
+				break
+			}
+		}
+		mux.unlock()
+
+		if done {
+			return success
+		}
+		if time.Now().After(deadline) {
+			return errFlushTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func packetKey(packet Stream) *byte {
+	if len(packet) == 0 {
+		return nil
+	}
+	return &packet[0]
+}
+
 func (mux *muxWriter) sender() {
-	domain, address := getDomainAndAddress(mux.port)
 	//	var remains []byte
 	var conn net.Conn
 
@@ -150,11 +373,19 @@ func (mux *muxWriter) sender() {
 	}
 
 	for { // (re-)connect loop
+		if mux.isClosed() {
+			return
+		}
+		mux.setConnected(false)
+
 		var err error
-		conn, err = net.DialTimeout(domain, address, timeoutDial)
+		conn, err = dial(mux.currentPort())
 		if err != success {
 			warning("#4: %v\n", err)
-			time.Sleep(time.Second * 10)
+			select {
+			case <-time.After(time.Second * 10):
+			case <-mux.redial: // retargeted (or closed)
+			}
 			continue // reconnect
 		}
 
@@ -164,7 +395,14 @@ func (mux *muxWriter) sender() {
 			continue
 		}
 
-		if err := sendStaticMetricInfo(); err != success {
+		if err := mux.announceStreams(write); err != success {
+			warning("#4c: %v\n", err)
+			conn.Close()
+			continue
+		}
+
+		mux.setConnected(true)
+		if err := sendMetricsSnapshot(); err != success {
 			warning("#4b: %v\n", err)
 			conn.Close()
 			continue
@@ -190,12 +428,20 @@ func (mux *muxWriter) sender() {
 			}
 		*/
 
+		// what was queued while disconnected (including the packets of failed writes) goes first
+		if err := mux.sendAllAvailableData(write); err != success {
+			conn.Close()
+			continue
+		}
+
 	Inner:
 		for { // data sending loop
 			select {
 			case a, channelOpen := <-mux.channel:
 				if !channelOpen {
 					warning("channel closed - quitting")
+					mux.sendAllAvailableData(write) // what was written before the mux was closed
+					conn.Close()
 					return
 				}
 
@@ -205,6 +451,14 @@ func (mux *muxWriter) sender() {
 				if err := mux.sendAllAvailableData(write); err != success {
 					break Inner
 				}
+
+			case <-mux.redial:
+				if mux.isClosed() {
+					mux.sendAllAvailableData(write) // what was written before the mux was closed
+					conn.Close()
+					return
+				}
+				break Inner
 			}
 		}
 
@@ -212,14 +466,46 @@ func (mux *muxWriter) sender() {
 	}
 }
 
+// (re-)sends the announcements of all the open named streams, the receiver sees them before any data;
+// the ones still queued (e.g. of the streams opened while disconnected) are taken off the queue, not to be sent twice
+func (mux *muxWriter) announceStreams(write func(b []byte) (n int, err error)) error {
+	mux.lock()
+	announcements := make([]Stream, 0, len(mux.announcements))
+	announced := make(map[string]bool, len(mux.announcements))
+	for _, announcement := range mux.announcements {
+		announcements = append(announcements, announcement)
+		announced[string(announcement)] = true
+	}
+	packets := mux.packets[:0]
+	for _, packet := range mux.packets {
+		if !announced[string(packet)] {
+			packets = append(packets, packet)
+		}
+	}
+	mux.packets = packets
+	mux.unlock()
+
+	for _, announcement := range announcements {
+		if _, err := write(announcement); err != success {
+			return err
+		}
+	}
+	return success
+}
+
 func (mux *muxWriter) sendAllAvailableData(write func(b []byte) (n int, err error)) error {
 	for {
+		if len(mux.redial) > 0 {
+			return success // the rest goes over the new connection (see retarget)
+		}
+
 		var data Stream
 
 		mux.lock()
 		if len(mux.packets) > 0 {
 			data = mux.packets[0]
 			mux.packets = mux.packets[1:]
+			mux.sending = data
 		}
 		mux.unlock()
 
@@ -228,16 +514,19 @@ func (mux *muxWriter) sendAllAvailableData(write func(b []byte) (n int, err erro
 			return success
 		}
 
-		if n, err := write(data); err != success {
+		n, err := write(data)
+
+		mux.lock()
+		mux.sending = nil
+		if err != success {
+			// the packet goes back to the front of the queue, it is sent (in full) on the next connection;
+			// note: until then Flush keeps waiting for it
+			mux.packets = append([]Stream{data}, mux.packets...)
+		}
+		mux.unlock()
+
+		if err != success {
 			warning("failed to write: %v\n", err)
-			/*
-				if n > 0 {
-					// looks like we managed to send "n" bytes - need to preserve the rest (to send on next connect)
-					if n < len(data) {
-						remains = data[n:]
-					}
-				}
-			*/
 			return err
 		} else if n != len(data) {
 			// todo: ???
@@ -0,0 +1,206 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the first connection is dropped by the other side right after the fingerprint,
+// the packet written then must make it over the second one
+func TestFailedWriteIsResent(t *testing.T) {
+	var dials int32
+	dropped := make(chan bool)
+	streams := NewStreamReaders(nil)
+
+	previous := SetDialer(func(port int) (net.Conn, error) {
+		client, server := net.Pipe()
+		if atomic.AddInt32(&dials, 1) == 1 {
+			go func() {
+				readFrame(server)
+				server.Close()
+				close(dropped)
+			}()
+		} else {
+			go ServeConn(server, func(props map[string]interface{}) Connection { return streams })
+		}
+		return client, nil
+	})
+	defer SetDialer(previous)
+
+	mux := CreateMuxWriter(0)
+	defer mux.(io.Closer).Close()
+
+	<-dropped
+	writer, _ := mux.NewWriter(User)
+	writer.Write([]byte("survives"))
+
+	if err := mux.Flush(5 * time.Second); err != success {
+		t.Fatalf("flush failed: %v", err)
+	}
+	mux.(io.Closer).Close()
+
+	data, _ := ioutil.ReadAll(streams.Reader(User))
+	if string(data) != "survives" {
+		t.Errorf("received (%s), expected (survives)", data)
+	}
+}
+
+func TestFlushFailsWhileDisconnected(t *testing.T) {
+	previous := SetDialer(func(port int) (net.Conn, error) { return nil, errNotConnected })
+	defer SetDialer(previous)
+
+	mux := CreateMuxWriter(0)
+	defer mux.(io.Closer).Close()
+
+	writer, _ := mux.NewWriter(User)
+	writer.Write([]byte("pending"))
+
+	if err := mux.Flush(50 * time.Millisecond); err != errFlushTimeout {
+		t.Errorf("flush returned (%v), expected (%v)", err, errFlushTimeout)
+	}
+}
+
+// the packets written after the flush started do not hold it up
+func TestFlushUnderSteadyTraffic(t *testing.T) {
+	previous := SetDialer(func(port int) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			for {
+				if _, _, err := readFrame(server); err != success {
+					return
+				}
+				time.Sleep(time.Millisecond) // a slow reader, the queue is never empty
+			}
+		}()
+		return client, nil
+	})
+	defer SetDialer(previous)
+
+	mux := CreateMuxWriter(0)
+	defer mux.(io.Closer).Close()
+
+	writer, _ := mux.NewWriter(User)
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				writer.Write([]byte("busy"))
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := mux.Flush(2 * time.Second); err != success {
+		t.Errorf("flush failed: %v", err)
+	}
+}
+
+func TestNamedStreamIdsAreReserved(t *testing.T) {
+	previous := SetDialer(func(port int) (net.Conn, error) { return nil, errNotConnected })
+	defer SetDialer(previous)
+
+	mux := CreateMuxWriter(0)
+	defer mux.(io.Closer).Close()
+
+	if _, err := mux.NewWriter(firstNamedStream); err != success {
+		t.Fatalf("failed to create a writer: %v", err)
+	}
+	named, _ := mux.OpenStream("named", "text/plain")
+	id := named.(*single).id
+	if id != firstNamedStream+1 {
+		t.Errorf("the named stream got id (%d), expected (%d)", id, firstNamedStream+1)
+	}
+	if _, err := mux.NewWriter(User); err != success {
+		t.Errorf("a user id is taken by the named stream: %v", err)
+	}
+
+	if _, err := mux.NewWriter(id); err != errStreamIdReserved {
+		t.Errorf("a writer for the id of a named stream returned (%v)", err)
+	}
+	named.Close()
+	if _, err := mux.NewWriter(id); err != errStreamIdReserved {
+		t.Errorf("the id of a closed named stream was given away (%v)", err)
+	}
+	if reopened, _ := mux.OpenStream("named", "text/plain"); reopened.(*single).id != id {
+		t.Errorf("the reopened stream got id (%d), expected (%d)", reopened.(*single).id, id)
+	}
+}
+
+// a stream opened while disconnected is announced once, not by both the queue and the announcements
+func TestStreamOpenedWhileDisconnectedIsAnnouncedOnce(t *testing.T) {
+	var ready int32
+	failed := make(chan bool, 1)
+	frames := make(chan int, 16)
+	previous := SetDialer(func(port int) (net.Conn, error) {
+		if atomic.LoadInt32(&ready) == 0 {
+			failed <- true
+			return nil, errNotConnected
+		}
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			for {
+				id, _, err := readFrame(server)
+				if err != success {
+					return
+				}
+				frames <- id
+			}
+		}()
+		return client, nil
+	})
+	defer SetDialer(previous)
+
+	mux := CreateMuxWriter(0).(*muxWriter)
+	defer mux.Close()
+
+	<-failed
+	named, _ := mux.OpenStream("late", "text/plain")
+	named.Write([]byte("data"))
+	atomic.StoreInt32(&ready, 1)
+	mux.retarget(1)
+
+	announcements := 0
+	for {
+		select {
+		case id := <-frames:
+			switch id {
+			case Streams:
+				announcements++
+			case named.(*single).id:
+				if announcements != 1 {
+					t.Errorf("the stream was announced (%d) times", announcements)
+				}
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no data received")
+		}
+	}
+}
+
+// reads one frame (see construct)
+func readFrame(conn net.Conn) (int, []byte, error) {
+	var prefix [prefixSize]byte
+	if _, err := io.ReadFull(conn, prefix[:]); err != success {
+		return 0, nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(prefix[sizeOfInt:]))
+	_, err := io.ReadFull(conn, data)
+	return int(binary.LittleEndian.Uint32(prefix[:])), data, err
+}
@@ -0,0 +1,40 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type (
+	// the payload of the packets sent on the Streams stream
+	StreamInfo struct {
+		ID          int    `json:"id"`
+		Name        string `json:"name"`
+		ContentType string `json:"content.type,omitempty"`
+	}
+)
+
+// opens a named stream on the pipes' connection; the id is allocated (from a range of its own, well above User)
+// and announced to the receiver, the announcement is repeated on every reconnect while the stream is open
+func OpenStream(name, contentType string) (io.WriteCloser, error) {
+	initPipes()
+
+	pipesGuard.Lock()
+	mux := pipesMux
+	pipesGuard.Unlock()
+
+	if mux == nil {
+		return nil, errNotConnected
+	}
+	return mux.OpenStream(name, contentType)
+}
+
+func ParseStreamInfo(data []byte) (StreamInfo, error) {
+	var info StreamInfo
+	err := json.Unmarshal(data, &info)
+	return info, err
+}
@@ -5,11 +5,11 @@
 package base
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -17,30 +17,52 @@ const (
 	Stderr  = 3
 	Logger  = 7
 	Metrics = 11
+	Exit    = 13 // exit code of a process launched through cmd/muxrun
+	Streams = 17 // announcements of the named streams (see OpenStream)
 	User    = 100
 )
 
 var (
-	pipesGuard                                      sync.Mutex
-	pipesInitalized                                 bool
-	pipeStdout, pipeStderr, pipeLogger, pipeMetrics io.Writer
+	pipesGuard      sync.Mutex
+	pipesInitalized bool
+	pipesMux        MuxWriter
+	pipesPort       int
+	pipesWatch      chan bool                 // closed to stop watching for port changes
+	pipes           = make(map[int]io.Writer) // kind -> writer
+
+	// the kinds the pipes are created for upon connect, other kinds are created on demand
+	builtinPipes = []int{Stdout, Stderr, Logger, Metrics}
+
+	// the kinds written by base (or cmd/muxrun) itself, GetPipe does not hand them out
+	reservedPipes = map[int]bool{idFinderPrint: true, Exit: true, Streams: true}
 )
 
+// returns the pipe of the specified kind, for the kinds other than the built-in ones
+// (e.g. User and above) the pipe is created on demand; nil if the kind is reserved (Exit, Streams)
+// or taken by a named stream (see OpenStream)
+//
+// note: the first call connects the pipes (same as any other use of them), i.e. discovers the receiver port,
+// dials it and (unless disabled) starts watching for port changes
 func GetPipe(kind int) io.Writer {
-	var pipe io.Writer
-	switch kind {
-	case Stdout:
-		pipe = pipeStdout
-	case Stderr:
-		pipe = pipeStderr
-	case Logger:
-		pipe = pipeLogger
-	case Metrics:
-		pipe = pipeMetrics
-	default:
+	if reservedPipes[kind] {
+		return nil
+	}
+	initPipes()
+
+	pipesGuard.Lock()
+	defer pipesGuard.Unlock()
+
+	if pipe, found := pipes[kind]; found {
+		return pipe
+	}
 
+	if pipesMux != nil {
+		if pipe, err := pipesMux.NewWriter(kind); err == success {
+			pipes[kind] = pipe
+			return pipe
+		}
 	}
-	return pipe
+	return nil
 }
 
 func SetPipe(kind int, writer io.Writer) {
@@ -48,75 +70,117 @@ func SetPipe(kind int, writer io.Writer) {
 		pipesGuard.Lock()
 		defer pipesGuard.Unlock()
 
-		switch kind {
-		case Stdout:
-			pipeStdout = writer
-		case Stderr:
-			pipeStderr = writer
-		case Logger:
-			pipeLogger = writer
-		case Metrics:
-			pipeMetrics = writer
-		default:
-
-		}
+		pipes[kind] = writer
 	}
 }
 
+// same as GetPipe, but neither initializes the pipes nor creates new ones
+func getPipe(kind int) io.Writer {
+	pipesGuard.Lock()
+	defer pipesGuard.Unlock()
+
+	return pipes[kind]
+}
+
 func Printf(format string, args ...interface{}) {
-	if pipeStdout != nil {
-		fmt.Fprintf(pipeStdout, format, args...)
+	if pipe := getPipe(Stdout); pipe != nil {
+		fmt.Fprintf(pipe, format, args...)
 	} else {
 		_, _ = fmt.Printf(format, args...)
 	}
 }
 
 func Errorf(format string, args ...interface{}) {
-	if pipeStderr != nil {
-		fmt.Fprintf(pipeStderr, format, args...)
+	if pipe := getPipe(Stderr); pipe != nil {
+		fmt.Fprintf(pipe, format, args...)
 	} else {
 		_, _ = fmt.Printf(format, args...)
 	}
 }
 
 func initPipes() {
+	pipesGuard.Lock()
+	defer pipesGuard.Unlock()
+
 	if pipesInitalized {
 		return
 	}
 
+	if ports, source := discoverPorts(); len(ports) > 0 {
+		GetLogger().Debugf("using receiver port %d (from %s)", ports[0], source)
+		connectPipes(ports[0])
+	} else {
+		GetLogger().Errorf("failed to find receiver ports (tried: %s)", strings.Join(portsSources(), ", "))
+	}
+
+	// opt-in: the receiver may come up (or move) later, the discovery sources are then polled
+	// every "ports.watch.interval" (5s by default)
+	if GetFlag("ports.watch", false) {
+		pipesWatch = make(chan bool)
+		go watchPorts(pipesWatch)
+	}
+	pipesInitalized = true
+}
+
+// connects the pipes to the receiver listening on the specified port, bypassing the port discovery
+func ConnectPipes(port int) {
 	pipesGuard.Lock()
 	defer pipesGuard.Unlock()
 
-	if pipesInitalized {
+	stopWatchingPorts()
+	connectPipes(port)
+	pipesInitalized = true
+}
+
+// note: expects pipesGuard to be locked
+func connectPipes(port int) {
+	pipesPort = port
+
+	if mux, ok := pipesMux.(*muxWriter); ok {
+		// the writers handed out so far (the pipes, the named streams) keep working, the sender redials;
+		// what is written meanwhile is sent over the new connection
+		mux.retarget(port)
 		return
 	}
 
-	ports := loadPorts()
-	if len(ports) > 0 {
-		mux := CreateMuxWriter(ports[0])
+	mux := CreateMuxWriter(port)
+	pipesMux = mux
+
+	for _, kind := range builtinPipes {
+		pipes[kind], _ = mux.NewWriter(kind)
+	}
+
+	GetLogger().SetOutput(pipes[Logger])
+}
 
-		pipeStdout, _ = mux.NewWriter(Stdout)
-		pipeStderr, _ = mux.NewWriter(Stderr)
-		pipeLogger, _ = mux.NewWriter(Logger)
-		pipeMetrics, _ = mux.NewWriter(Metrics)
+// waits (up to the specified timeout) till everything written to the pipes is sent
+func FlushPipes(timeout time.Duration) error {
+	pipesGuard.Lock()
+	mux := pipesMux
+	pipesGuard.Unlock()
 
-		pipesInitalized = true
-		GetLogger().SetOutput(pipeLogger)
+	if mux == nil {
+		return success
 	}
-	pipesInitalized = true
+	return mux.Flush(timeout)
 }
 
-func loadPorts() []int {
-	filename := GetValue("ports.filename", "port.json")
-	if data, err := ioutil.ReadFile(filename); err == nil {
-		var receiver []int
-		if err := json.Unmarshal(data, &receiver); err == nil {
-			return receiver
-		} else {
-			GetLogger().WithError(err).Errorf("failed to unmarshal []int")
-		}
-	} else {
-		GetLogger().WithError(err).Errorf("failed to read file (%s)", filename)
+func resetPipes() {
+	pipesGuard.Lock()
+	defer pipesGuard.Unlock()
+
+	if closer, ok := pipesMux.(io.Closer); ok {
+		closer.Close()
 	}
-	return nil
+
+	if pipesMux != nil {
+		GetLogger().SetOutput(getLogOutput())
+	}
+
+	stopWatchingPorts()
+
+	pipesMux = nil
+	pipesPort = 0
+	pipes = make(map[int]io.Writer)
+	pipesInitalized = false
 }
@@ -0,0 +1,110 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+func TestGetPipe(t *testing.T) {
+	kit := basetest.New(t)
+
+	for _, kind := range []int{0, base.Exit, base.Streams} {
+		if pipe := base.GetPipe(kind); pipe != nil {
+			t.Errorf("got a pipe of reserved kind (%d)", kind)
+		}
+	}
+	pipe := base.GetPipe(base.User)
+	if pipe == nil || base.GetPipe(base.User) != pipe {
+		t.Fatalf("expected the same pipe of kind (User) every time")
+	}
+	pipe.Write([]byte("user data"))
+	kit.AssertContains(base.User, "user data")
+}
+
+// the first lookup connects the pipes to the discovered port
+func TestGetPipeConnects(t *testing.T) {
+	kit := basetest.New(t)
+	base.ResetState() // not connected, the loopback is still the dialer
+
+	defer os.Setenv("BASE_PORTS", os.Getenv("BASE_PORTS"))
+	os.Setenv("BASE_PORTS", "7777")
+
+	pipe := base.GetPipe(base.User + 1)
+	if pipe == nil {
+		t.Fatalf("failed to get the pipe")
+	}
+	pipe.Write([]byte("discovered"))
+	kit.AssertContains(base.User+1, "discovered")
+}
+
+// the writers handed out before the port changes keep working after it
+func TestWritersSurvivePortChange(t *testing.T) {
+	kit := basetest.New(t)
+
+	pipe := base.GetPipe(base.User + 5)
+	named, err := base.OpenStream("events", "text/plain")
+	if pipe == nil || err != nil {
+		t.Fatalf("failed to get the writers: %v", err)
+	}
+	kit.AssertConnected()
+
+	base.ConnectPipes(1) // the loopback ignores the port, it is a new connection nevertheless
+
+	if _, err := pipe.Write([]byte("pipe after")); err != nil {
+		t.Errorf("the pipe failed: %v", err)
+	}
+	if _, err := named.Write([]byte("stream after")); err != nil {
+		t.Errorf("the named stream failed: %v", err)
+	}
+
+	kit.AssertContains(base.User+5, "pipe after")
+	info, _ := kit.Stream("events")
+	kit.AssertContains(info.ID, "stream after")
+	if !kit.WaitFor(func() bool { return len(kit.Fingerprints()) >= 2 }, kit.Timeout) {
+		t.Errorf("the pipes did not reconnect")
+	}
+	if frames := kit.Frames(base.Streams); len(frames) < 2 {
+		t.Errorf("the named stream was not announced again, announcements: (%d)", len(frames))
+	}
+}
+
+// the metrics collected while disconnected are not queued up, the receiver gets the snapshot of the latest values
+func TestMetricsAfterReconnect(t *testing.T) {
+	kit := basetest.New(t)
+
+	level := base.CreateNewMetric("level", "Level", "")
+	level.Update("0")
+	kit.AssertMetric("level", "0")
+
+	base.SetDialer(func(port int) (net.Conn, error) { return nil, errors.New("the receiver is down") })
+	kit.Loopback.Disconnect()
+	for i := 1; i <= 3; i++ {
+		level.Update(strconv.Itoa(i))
+		time.Sleep(1200 * time.Millisecond) // flushed (see "metrics.flush.interval") while disconnected
+	}
+
+	sent := len(kit.Frames(base.Metrics))
+	base.SetDialer(kit.Loopback.Dial)
+	base.ConnectPipes(1)
+
+	kit.AssertMetric("level", "3")
+	if values := kit.MetricValues("level"); len(values) != 2 {
+		t.Errorf("expected the value before the drop and the latest one, received %q", values)
+	}
+	// the frames queued while disconnected would come first, with the updates of indexes not yet published
+	records, err := base.DecodeMetricRecords(kit.Frames(base.Metrics)[sent])
+	if err != nil || len(records) == 0 || records[0].Kind != base.RecordPublish {
+		t.Errorf("the first frame after the reconnect is not the snapshot: %+v, %v", records, err)
+	}
+}
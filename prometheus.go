@@ -0,0 +1,276 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	contentTypePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+type (
+	// a metric family, as exposed to Prometheus
+	promFamily struct {
+		name    string
+		help    string
+		kind    string // counter, gauge, histogram, summary
+		source  string // the id of the vector (or of the metric) the samples come from
+		samples []promSample
+	}
+
+	promSample struct {
+		suffix string // e.g. _bucket, _sum
+		labels []Label
+		value  float64
+	}
+)
+
+var (
+	// units (lower case) with a conventional suffix, the rest are appended as they are (sanitized)
+	promUnits = map[string]string{
+		"":             "",
+		"count":        "",
+		"s":            "seconds",
+		"sec":          "seconds",
+		"second":       "seconds",
+		"seconds":      "seconds",
+		"ms":           "milliseconds",
+		"millisecond":  "milliseconds",
+		"milliseconds": "milliseconds",
+		"us":           "microseconds",
+		"microseconds": "microseconds",
+		"ns":           "nanoseconds",
+		"nanoseconds":  "nanoseconds",
+		"b":            "bytes",
+		"byte":         "bytes",
+		"bytes":        "bytes",
+		"%":            "percent",
+		"percent":      "percent",
+		"ratio":        "ratio",
+	}
+
+	// the ids already reported as colliding with another family (guarded by metricsGuard)
+	promCollisions = map[string]bool{}
+)
+
+// serves the metrics of this process in the Prometheus text exposition format;
+// it reads the metrics store directly, so it works whether or not there is a receiver to push the metrics to
+//
+//	http.Handle("/metrics", base.PrometheusHandler())
+func PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypePrometheus)
+		if err := WritePrometheus(w); err != success {
+			warning("failed to write the metrics: %v\n", err)
+		}
+	})
+}
+
+// writes the metrics of this process in the Prometheus text exposition format:
+// counters are exposed as counters, numeric metrics as gauges and string metrics as info-style series
+// (a "value" label and 1 as the value); the names are made of the ids (or the ids of the vectors) and the units
+func WritePrometheus(w io.Writer) error {
+	media := bufio.NewWriter(w)
+	for _, family := range promFamilies() {
+		media.WriteString("# HELP " + family.name + " " + promEscape(family.help, false) + "\n")
+		media.WriteString("# TYPE " + family.name + " " + family.kind + "\n")
+		for _, sample := range family.samples {
+			media.WriteString(family.name + sample.suffix)
+			if len(sample.labels) > 0 {
+				parts := make([]string, len(sample.labels))
+				for i, label := range sample.labels {
+					parts[i] = promSanitize(label.Name) + `="` + promEscape(label.Value, true) + `"`
+				}
+				media.WriteString("{" + strings.Join(parts, ",") + "}")
+			}
+			media.WriteString(" " + promFloat(sample.value) + "\n")
+		}
+	}
+	return media.Flush()
+}
+
+// the families in the order their first members were registered
+func promFamilies() []*promFamily {
+	families := []*promFamily{}
+	byName := map[string]*promFamily{}
+
+	metricsGuard.Lock()
+	defer metricsGuard.Unlock()
+
+	metricsStore.each(func(ms *metricClient) {
+		kind, samples := promSamples(ms)
+		if len(samples) == 0 {
+			return
+		}
+
+		id := ms.id
+		if len(ms.family) > 0 {
+			id = ms.family
+		}
+		name := promName(id, ms.units)
+		switch {
+		case ms.kind == TypeCounter:
+			name += "_total"
+		case ms.kind == TypeMetric && kind == "info":
+			name += "_info"
+			kind = "gauge"
+		}
+
+		family := byName[name]
+		if family == nil {
+			family = &promFamily{name: name, help: ms.name, kind: kind, source: id}
+			byName[name] = family
+			families = append(families, family)
+		} else if family.kind != kind || family.source != id {
+			// the name is taken by another family (e.g. "a.b" and "a_b"), merging would expose duplicate series
+			if !promCollisions[ms.id] {
+				promCollisions[ms.id] = true
+				warning("metric (%s) is not exposed to Prometheus, its name (%s) is taken by (%s)\n", ms.id, name, family.source)
+			}
+			return
+		}
+		family.samples = append(family.samples, samples...)
+	})
+	return families
+}
+
+// note: expects metricsGuard to be locked
+func promSamples(ms *metricClient) (string, []promSample) {
+	switch ms.kind {
+	case TypeCounter:
+		return "counter", []promSample{{labels: ms.labels, value: float64(atomic.LoadInt64(&ms.counter))}}
+
+	case TypeGauge:
+		return "gauge", []promSample{{labels: ms.labels, value: math.Float64frombits(atomic.LoadUint64(&ms.gauge))}}
+
+	case TypeHistogram:
+		value, ok := ms.current().value.(HistogramValue)
+		if !ok {
+			value = HistogramValue{Buckets: make([]Bucket, len(ms.buckets))}
+			for i, bound := range ms.buckets {
+				value.Buckets[i].UpperBound = bound
+			}
+		}
+		labels := promLabels(ms.labels, "le")
+		samples := make([]promSample, 0, len(value.Buckets)+3)
+		for _, bucket := range value.Buckets {
+			le := Label{Name: "le", Value: promFloat(bucket.UpperBound)}
+			samples = append(samples, promSample{suffix: "_bucket", labels: withLabel(labels, le), value: float64(bucket.Count)})
+		}
+		inf := Label{Name: "le", Value: "+Inf"}
+		samples = append(samples,
+			promSample{suffix: "_bucket", labels: withLabel(labels, inf), value: float64(value.Count)},
+			promSample{suffix: "_sum", labels: labels, value: value.Sum},
+			promSample{suffix: "_count", labels: labels, value: float64(value.Count)})
+		return "histogram", samples
+
+	case TypeSummary:
+		value, _ := ms.current().value.(SummaryValue)
+		labels := promLabels(ms.labels, "quantile")
+		samples := make([]promSample, 0, len(value.Quantiles)+2)
+		for _, q := range value.Quantiles {
+			quantile := Label{Name: "quantile", Value: promFloat(q.Quantile)}
+			samples = append(samples, promSample{labels: withLabel(labels, quantile), value: q.Value})
+		}
+		samples = append(samples,
+			promSample{suffix: "_sum", labels: labels, value: value.Sum},
+			promSample{suffix: "_count", labels: labels, value: float64(value.Count)})
+		return "summary", samples
+
+	default:
+		switch value := ms.current().value.(type) {
+		case int64:
+			return "gauge", []promSample{{labels: ms.labels, value: float64(value)}}
+		case float64:
+			return "gauge", []promSample{{labels: ms.labels, value: value}}
+		case string:
+			info := Label{Name: "value", Value: value}
+			return "info", []promSample{{labels: withLabel(promLabels(ms.labels, "value"), info), value: 1}}
+		}
+		return "", nil // nothing posted yet
+	}
+}
+
+// a vector label named as the one the family adds (e.g. "le" of the histograms) is exposed as "exported_<name>"
+func promLabels(labels []Label, reserved string) []Label {
+	for i, label := range labels {
+		if label.Name == reserved {
+			renamed := append([]Label(nil), labels...)
+			renamed[i].Name = "exported_" + reserved
+			return renamed
+		}
+	}
+	return labels
+}
+
+func withLabel(labels []Label, label Label) []Label {
+	return append(append(make([]Label, 0, len(labels)+1), labels...), label)
+}
+
+// e.g. "http.latency" in "ms" becomes http_latency_milliseconds
+func promName(id, units string) string {
+	name := promSanitize(id)
+
+	suffix, known := promUnits[strings.ToLower(units)]
+	if !known {
+		suffix = promSanitize(strings.ToLower(units))
+	}
+	if len(suffix) > 0 && !strings.HasSuffix(name, "_"+suffix) {
+		name += "_" + suffix
+	}
+	return name
+}
+
+// replaces whatever is not allowed in a name with '_', colons included (they are meant for the recording rules)
+func promSanitize(text string) string {
+	var name strings.Builder
+	for i, c := range text {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+			name.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				name.WriteByte('_')
+			}
+			name.WriteRune(c)
+		default:
+			name.WriteByte('_')
+		}
+	}
+	if name.Len() == 0 {
+		return "_"
+	}
+	return name.String()
+}
+
+func promEscape(text string, quoted bool) string {
+	text = strings.Replace(text, `\`, `\\`, -1)
+	text = strings.Replace(text, "\n", `\n`, -1)
+	if quoted {
+		text = strings.Replace(text, `"`, `\"`, -1)
+	}
+	return text
+}
+
+func promFloat(value float64) string {
+	switch {
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"testing"
+)
+
+// a collision is reported once, but once per state: the next test (or reset) reports it again
+func TestPrometheusCollisionsReset(t *testing.T) {
+	ResetState()
+	defer ResetState()
+
+	CreateNewCounter("reset.a", "Dotted", "count").Add(1)
+	CreateNewCounter("reset_a", "Underscored", "count").Add(1)
+	promFamilies()
+
+	metricsGuard.Lock()
+	reported := promCollisions["reset_a"]
+	metricsGuard.Unlock()
+	if !reported {
+		t.Fatalf("the collision was not reported")
+	}
+
+	ResetState()
+	metricsGuard.Lock()
+	defer metricsGuard.Unlock()
+	if len(promCollisions) != 0 {
+		t.Errorf("the collisions outlived the reset: %v", promCollisions)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+// ids sanitized to the same name must not end up as duplicate series of one family
+func TestPrometheusNameCollision(t *testing.T) {
+	basetest.New(t)
+
+	base.CreateNewCounter("a.b", "Dotted", "count").Add(1)
+	base.CreateNewCounter("a_b", "Underscored", "count").Add(2)
+	requests := base.CreateCounterVec("requests", "Requests", "count", "code")
+	requests.With("200").Add(3)
+	requests.With("500").Add(4)
+
+	var output bytes.Buffer
+	if err := base.WritePrometheus(&output); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	text := output.String()
+
+	if count := strings.Count(text, "\na_b_total "); count != 1 || !strings.Contains(text, "\na_b_total 1\n") {
+		t.Errorf("expected the first of the colliding metrics only, got:\n%s", text)
+	}
+	if strings.Count(text, "# TYPE a_b_total") != 1 {
+		t.Errorf("the family is declared more than once:\n%s", text)
+	}
+	if !strings.Contains(text, `requests_total{code="200"} 3`) || !strings.Contains(text, `requests_total{code="500"} 4`) {
+		t.Errorf("the members of a vector are expected in one family:\n%s", text)
+	}
+}
+
+// the vector labels named as the ones a histogram (or a summary) adds must not clash with them
+func TestPrometheusReservedLabels(t *testing.T) {
+	basetest.New(t)
+
+	base.CreateHistogramVec("latency", "Latency", "seconds", []float64{0.1, 1}, "le").With("fast").Observe(0.05)
+	base.CreateSummaryVec("size", "Size", "bytes", []float64{0.5}, "quantile").With("big").Observe(2048)
+	base.CreateMetricVec("version", "Version", "", "value").With("current").Update("1.2.3")
+
+	var output bytes.Buffer
+	if err := base.WritePrometheus(&output); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	text := output.String()
+
+	for _, expected := range []string{
+		`latency_seconds_bucket{exported_le="fast",le="+Inf"}`,
+		`latency_seconds_count{exported_le="fast"}`,
+		`size_bytes_sum{exported_quantile="big"}`,
+		`version_info{exported_value="current",value="1.2.3"} 1`,
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected (%s) in:\n%s", expected, text)
+		}
+	}
+	for _, clash := range []string{`le="fast"`, `quantile="big"`, `value="current"`} {
+		if strings.Contains(text, "{"+clash) || strings.Contains(text, ","+clash) {
+			t.Errorf("the label (%s) is exposed as it is:\n%s", clash, text)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	ps "github.com/mitchellh/go-ps"
+)
+
+const (
+	suffixLock = ".lock"
+)
+
+// writes the port into the ports file (in the format loadPorts reads), atomically:
+// the data goes into a temp file that is then renamed; the lock file (holding the pid of the owner)
+// keeps other receivers from publishing into the same file
+func publishPort(filename string, port int) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	if err := lockPortsFile(filename); err != success {
+		return err
+	}
+
+	data, err := json.Marshal([]int{port})
+	if err != success {
+		unlockPortsFile(filename)
+		return err
+	}
+
+	if err := writeFileAtomically(filename, data); err != success {
+		unlockPortsFile(filename)
+		return err
+	}
+	return success
+}
+
+func unpublishPort(filename string) error {
+	err := os.Remove(filename)
+	unlockPortsFile(filename)
+
+	if os.IsNotExist(err) {
+		return success
+	}
+	return err
+}
+
+func writeFileAtomically(filename string, data []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := os.Rename(temp.Name(), filename); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return success
+}
+
+func lockPortsFile(filename string) error {
+	lock := filename + suffixLock
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = file.WriteString(strconv.Itoa(os.Getpid()))
+			file.Close()
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		if !staleLock(lock) {
+			return errPortsFileLocked
+		}
+		// the owner is gone (without cleaning up) - take over
+		os.Remove(lock)
+	}
+	return errPortsFileLocked
+}
+
+// removes the lock, but only if it is ours
+func unlockPortsFile(filename string) {
+	lock := filename + suffixLock
+	if pid, err := lockOwner(lock); err == success && pid == os.Getpid() {
+		os.Remove(lock)
+	}
+}
+
+func staleLock(lock string) bool {
+	pid, err := lockOwner(lock)
+	if err != success {
+		// not written (yet?), give the owner a moment before assuming it died in the middle
+		info, err := os.Stat(lock)
+		return err == nil && time.Since(info.ModTime()) > time.Second
+	}
+
+	process, err := ps.FindProcess(pid)
+	return err == nil && process == nil
+}
+
+func lockOwner(lock string) (int, error) {
+	data, err := ioutil.ReadFile(lock)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
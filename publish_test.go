@@ -0,0 +1,74 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPublishPort(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "port.json")
+
+	if err := publishPort(filename, 7777); err != success {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if ports, err := loadPorts(filename); err != success || len(ports) != 1 || ports[0] != 7777 {
+		t.Errorf("loaded (%v), %v", ports, err)
+	}
+	if pid, err := lockOwner(filename + suffixLock); err != success || pid != os.Getpid() {
+		t.Errorf("the lock is owned by (%d), %v", pid, err)
+	}
+
+	// another receiver (of this very process, the owner is alive)
+	if err := publishPort(filename, 8888); err != errPortsFileLocked {
+		t.Errorf("publishing into a locked file returned (%v)", err)
+	}
+
+	if err := unpublishPort(filename); err != success {
+		t.Fatalf("failed to unpublish: %v", err)
+	}
+	if fileExists(filename) || fileExists(filename+suffixLock) {
+		t.Errorf("the ports file (or its lock) is still there")
+	}
+}
+
+// the receiver that published the file was killed: the file is ignored and the next receiver takes over
+func TestStalePortsFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "port.json")
+
+	child := exec.Command(os.Args[0], "-test.run=^$")
+	if err := child.Run(); err != nil {
+		t.Fatalf("failed to run the child: %v", err)
+	}
+	ioutil.WriteFile(filename, []byte("[7777]"), 0600)
+	ioutil.WriteFile(filename+suffixLock, []byte(strconv.Itoa(child.Process.Pid)), 0600)
+
+	if ports, err := loadPorts(filename); err != errStalePortsFile {
+		t.Errorf("loaded (%v) from a stale file, %v", ports, err)
+	}
+
+	if err := publishPort(filename, 8888); err != success {
+		t.Fatalf("failed to take over: %v", err)
+	}
+	defer unpublishPort(filename)
+	if ports, err := loadPorts(filename); err != success || len(ports) != 1 || ports[0] != 8888 {
+		t.Errorf("loaded (%v), %v", ports, err)
+	}
+}
+
+// a file written by hand has no lock
+func TestPortsFileWithoutLock(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "port.json")
+	ioutil.WriteFile(filename, []byte("7777,7778"), 0600)
+
+	if ports, err := loadPorts(filename); err != success || len(ports) != 2 {
+		t.Errorf("loaded (%v), %v", ports, err)
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+// brings the package-global state (pipes, metrics, exporters, fingerprint facts) back to its initial state;
+// meant to be used between tests (see the basetest package)
+func ResetState() {
+	resetPipes()
+	resetMetrics()
+	StopStatsD()
+	resetRuntimeMetrics()
+	resetWatchers()
+	resetPersistence()
+	resetCrashCounter()
+	resetFingerprint()
+}
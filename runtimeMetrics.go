@@ -0,0 +1,167 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRuntimeInterval = 10 * time.Second
+)
+
+type (
+	// the standard metrics of the Go runtime and (where supported) of the process
+	runtimeCollector struct {
+		goroutines   Metric
+		heapAlloc    Metric
+		heapSys      Metric
+		heapObjects  Metric
+		gcCount      Counter
+		gcPauseTotal Metric
+		gcPauseLast  Metric
+		cgoCalls     Counter
+
+		process *processMetrics // nil if the platform is not supported
+	}
+
+	processMetrics struct {
+		rss       Metric
+		cpuUser   Metric
+		cpuSystem Metric
+		fds       Metric
+		threads   Metric
+	}
+
+	// see readProcessStats
+	processStats struct {
+		rss       uint64  // bytes
+		cpuUser   float64 // seconds
+		cpuSystem float64 // seconds
+		fds       int
+		threads   int
+	}
+)
+
+var (
+	runtimeGuard     sync.Mutex
+	runtimeCollected *runtimeCollector // the metrics are created once (they would be redundant otherwise)
+	runtimeStop      chan bool         // nil if not running
+)
+
+// starts refreshing the runtime metrics (goroutines, heap, GC, cgo calls) and, on linux, the process ones
+// (RSS, CPU time, open fds, threads) every interval; a zero interval is taken from "metrics.runtime.interval".
+// it is also started along with the metrics if the "metrics.runtime" flag is set
+func StartRuntimeMetrics(interval time.Duration) {
+	if interval <= 0 {
+		interval = GetDuration("metrics.runtime.interval", 100*time.Millisecond, time.Hour, defaultRuntimeInterval)
+	}
+
+	runtimeGuard.Lock()
+	defer runtimeGuard.Unlock()
+
+	if runtimeStop != nil {
+		close(runtimeStop)
+	}
+	if runtimeCollected == nil {
+		runtimeCollected = newRuntimeCollector()
+	}
+	runtimeStop = make(chan bool)
+
+	runtimeCollected.refresh()
+	go runtimeCollected.run(interval, runtimeStop)
+}
+
+func StopRuntimeMetrics() {
+	runtimeGuard.Lock()
+	defer runtimeGuard.Unlock()
+
+	if runtimeStop != nil {
+		close(runtimeStop)
+		runtimeStop = nil
+	}
+}
+
+func startRuntimeMetricsFromConfig() {
+	if GetFlag("metrics.runtime", false) {
+		go StartRuntimeMetrics(0) // the metrics guard is locked at this point (see createNewMetric)
+	}
+}
+
+func resetRuntimeMetrics() {
+	StopRuntimeMetrics()
+
+	runtimeGuard.Lock()
+	defer runtimeGuard.Unlock()
+
+	runtimeCollected = nil
+}
+
+func newRuntimeCollector() *runtimeCollector {
+	collector := &runtimeCollector{
+		goroutines:   CreateNewMetric("runtime.goroutines", "Goroutines", "count"),
+		heapAlloc:    CreateNewMetric("runtime.heap.alloc", "Heap in use", "bytes"),
+		heapSys:      CreateNewMetric("runtime.heap.sys", "Heap obtained from the OS", "bytes"),
+		heapObjects:  CreateNewMetric("runtime.heap.objects", "Heap objects", "count"),
+		gcCount:      CreateNewCounter("runtime.gc.count", "GC cycles", "count"),
+		gcPauseTotal: CreateNewMetric("runtime.gc.pause.total", "GC pauses (total)", "seconds"),
+		gcPauseLast:  CreateNewMetric("runtime.gc.pause.last", "GC pause (last)", "seconds"),
+		cgoCalls:     CreateNewCounter("runtime.cgo.calls", "Cgo calls", "count"),
+	}
+
+	if _, supported := readProcessStats(); supported {
+		collector.process = &processMetrics{
+			rss:       CreateNewMetric("process.rss", "Resident memory", "bytes"),
+			cpuUser:   CreateNewMetric("process.cpu.user", "CPU time (user)", "seconds"),
+			cpuSystem: CreateNewMetric("process.cpu.system", "CPU time (system)", "seconds"),
+			fds:       CreateNewMetric("process.fds", "Open file descriptors", "count"),
+			threads:   CreateNewMetric("process.threads", "Threads", "count"),
+		}
+	}
+	return collector
+}
+
+func (collector *runtimeCollector) run(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			collector.refresh()
+		}
+	}
+}
+
+func (collector *runtimeCollector) refresh() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	collector.goroutines.Update(runtime.NumGoroutine())
+	collector.heapAlloc.Update(int64(mem.HeapAlloc))
+	collector.heapSys.Update(int64(mem.HeapSys))
+	collector.heapObjects.Update(int64(mem.HeapObjects))
+	collector.gcCount.Set(int64(mem.NumGC))
+	collector.gcPauseTotal.Update(time.Duration(mem.PauseTotalNs).Seconds())
+	if mem.NumGC > 0 {
+		collector.gcPauseLast.Update(time.Duration(mem.PauseNs[(mem.NumGC+255)%256]).Seconds())
+	}
+	collector.cgoCalls.Set(runtime.NumCgoCall())
+
+	if collector.process == nil {
+		return
+	}
+	if stats, ok := readProcessStats(); ok {
+		collector.process.rss.Update(int64(stats.rss))
+		collector.process.cpuUser.Update(stats.cpuUser)
+		collector.process.cpuSystem.Update(stats.cpuSystem)
+		collector.process.fds.Update(stats.fds)
+		collector.process.threads.Update(stats.threads)
+	}
+}
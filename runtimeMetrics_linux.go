@@ -0,0 +1,55 @@
+// +build linux
+
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+const (
+	clockTicks = 100 // USER_HZ, the unit of the CPU times in /proc (it is 100 on all the supported architectures)
+)
+
+// reads /proc/self/stat and counts the entries of /proc/self/fd
+func readProcessStats() (processStats, bool) {
+	var stats processStats
+
+	data, err := ioutil.ReadFile("/proc/self/stat")
+	if err != success {
+		return stats, false
+	}
+
+	// the command (2nd field) is in parentheses and may contain spaces, the fields after it are:
+	// state (3) ... utime (14) stime (15) ... num_threads (20) ... rss (24, pages)
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return stats, false
+	}
+	fields := bytes.Fields(data[end+1:])
+	field := func(n int) uint64 {
+		if index := n - 3; index < len(fields) {
+			value, _ := strconv.ParseUint(string(fields[index]), 10, 64)
+			return value
+		}
+		return 0
+	}
+
+	stats.cpuUser = float64(field(14)) / clockTicks
+	stats.cpuSystem = float64(field(15)) / clockTicks
+	stats.threads = int(field(20))
+	stats.rss = field(24) * uint64(os.Getpagesize())
+
+	if dir, err := os.Open("/proc/self/fd"); err == success {
+		names, _ := dir.Readdirnames(-1)
+		dir.Close()
+		stats.fds = len(names) - 1 // the one just opened (to read the directory) is not counted
+	}
+	return stats, true
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+// todo: the process stats of the other platforms
+func readProcessStats() (processStats, bool) {
+	return processStats{}, false
+}
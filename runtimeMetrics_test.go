@@ -0,0 +1,82 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base_test
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+func TestRuntimeMetrics(t *testing.T) {
+	kit := basetest.New(t)
+
+	runtime.GC()
+	base.StartRuntimeMetrics(100 * time.Millisecond)
+	base.StartRuntimeMetrics(100 * time.Millisecond) // restarts, the metrics are not created again
+	defer base.StopRuntimeMetrics()
+
+	ids := []string{"runtime.goroutines", "runtime.heap.alloc", "runtime.heap.sys", "runtime.heap.objects", "runtime.gc.count"}
+	if runtime.GOOS == "linux" {
+		ids = append(ids, "process.rss", "process.fds", "process.threads")
+	}
+	for _, id := range ids {
+		if states := base.SnapshotMetrics(id); len(states) != 1 {
+			t.Errorf("expected one (%s), got %+v", id, states)
+		}
+		positive := func() bool {
+			last, _ := kit.Metric(id)
+			value, err := strconv.ParseFloat(last, 64)
+			return err == nil && value > 0
+		}
+		if !kit.WaitFor(positive, kit.Timeout) {
+			t.Errorf("metric (%s) did not get a value above zero, received %q", id, kit.MetricValues(id))
+		}
+	}
+}
+
+// the metrics follow the runtime, till stopped
+func TestRuntimeMetricsRefresh(t *testing.T) {
+	kit := basetest.New(t)
+
+	base.StartRuntimeMetrics(100 * time.Millisecond)
+	defer base.StopRuntimeMetrics()
+	kit.AssertConnected()
+
+	goroutines := func() int {
+		states := base.SnapshotMetrics("runtime.goroutines")
+		if len(states) != 1 {
+			return 0
+		}
+		value, _ := states[0].Value.(int64)
+		return int(value)
+	}
+	if !kit.WaitFor(func() bool { return goroutines() > 0 }, kit.Timeout) {
+		t.Fatalf("the goroutines are not counted")
+	}
+	before := goroutines()
+
+	const started = 50
+	stop := make(chan bool)
+	for i := 0; i < started; i++ {
+		go func() { <-stop }()
+	}
+	if !kit.WaitFor(func() bool { return goroutines() >= before+started }, kit.Timeout) {
+		t.Errorf("the goroutines went from (%d) to (%d), expected (%d) more", before, goroutines(), started)
+	}
+
+	base.StopRuntimeMetrics()
+	time.Sleep(50 * time.Millisecond) // a refresh under way when stopped
+	close(stop)
+	stopped := goroutines()
+	time.Sleep(300 * time.Millisecond)
+	if current := goroutines(); current != stopped {
+		t.Errorf("the metric changed from (%d) to (%d) after the stop", stopped, current)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultStatsdFingerprintTags = "name;id;hostname"
+	maxStatsdUDPPacket           = 1432 // fits the usual MTU
+	maxStatsdUnixPacket          = 8192
+	timeoutStatsdWrite           = 100 * time.Millisecond
+)
+
+type (
+	// sends the metric updates (as the collector flushes them) as DogStatsD datagrams
+	statsdExporter struct {
+		conn      net.Conn
+		prefix    string
+		tags      []string
+		maxPacket int
+		counters  map[Index]int64 // the totals sent so far, by index (statsd counters take deltas)
+		batch     bytes.Buffer
+		remove    func() // removes the metrics listener
+	}
+)
+
+var (
+	statsdGuard    sync.Mutex
+	statsdInstance *statsdExporter
+)
+
+// starts sending the metric updates to a (Dog)StatsD agent; the address is one of:
+// "udp://host:port", "host:port", "unixgram:///path/to/socket" (an empty one is taken from "statsd.address");
+// the updates are batched into datagrams as the collector flushes them (once a tick),
+// tagged with "log.tags" and the fingerprint facts listed in "statsd.fingerprint.tags"
+func StartStatsD(address string) error {
+	if len(address) == 0 {
+		address = GetValue("statsd.address", "")
+	}
+	if len(address) == 0 {
+		return errNoStatsdAddress
+	}
+
+	network, target := statsdNetwork(address)
+	conn, err := net.Dial(network, target)
+	if err != success {
+		return err
+	}
+
+	maxPacket := maxStatsdUDPPacket
+	if network != "udp" {
+		maxPacket = maxStatsdUnixPacket
+	}
+
+	exporter := &statsdExporter{
+		conn:      conn,
+		prefix:    GetValue("statsd.prefix", ""),
+		tags:      statsdTags(),
+		maxPacket: GetInt("statsd.max.packet", 512, 65000, maxPacket),
+		counters:  make(map[Index]int64),
+	}
+
+	statsdGuard.Lock()
+	defer statsdGuard.Unlock()
+
+	if statsdInstance != nil {
+		statsdInstance.stop()
+	}
+	exporter.remove = addMetricsListener(exporter.export)
+	statsdInstance = exporter
+	return success
+}
+
+func StopStatsD() {
+	statsdGuard.Lock()
+	defer statsdGuard.Unlock()
+
+	if statsdInstance != nil {
+		statsdInstance.stop()
+		statsdInstance = nil
+	}
+}
+
+// starts the exporter if "statsd.address" is set
+func startStatsDFromConfig() {
+	if address := GetValue("statsd.address", ""); len(address) > 0 {
+		if err := StartStatsD(address); err != success {
+			warning("failed to start the statsd exporter (%s): %v\n", address, err)
+		}
+	}
+}
+
+func statsdNetwork(address string) (string, string) {
+	for _, network := range []string{"udp", "unixgram", "unix"} {
+		if prefix := network + "://"; strings.HasPrefix(address, prefix) {
+			if network == "unix" {
+				network = "unixgram"
+			}
+			return network, address[len(prefix):]
+		}
+	}
+	return "udp", address
+}
+
+func statsdTags() []string {
+	tags := []string{}
+	for _, tag := range strings.Split(GetValue("log.tags", ""), ";") {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			tags = append(tags, statsdSanitize(tag))
+		}
+	}
+
+	facts, err := extractFingerprint(assembleFingerprint())
+	if err != success {
+		return tags
+	}
+	for _, key := range strings.Split(GetValue("statsd.fingerprint.tags", defaultStatsdFingerprintTags), ";") {
+		if value, found := facts[key]; found && len(key) > 0 {
+			tags = append(tags, statsdSanitize(key+":"+fmt.Sprint(value)))
+		}
+	}
+	return tags
+}
+
+// note: called on the sender's goroutine
+func (exporter *statsdExporter) export(updates []clentUpdate) {
+	for _, update := range updates {
+		if update.removal != nil {
+			// the index may be given to another metric from now on
+			delete(exporter.counters, update.index)
+			continue
+		}
+
+		metricsGuard.Lock()
+		metric := metricsStore.get(update.index)
+		metricsGuard.Unlock()
+
+		if metric == nil {
+			continue
+		}
+		exporter.add(metric, update.index, update.value)
+	}
+	exporter.flush()
+}
+
+func (exporter *statsdExporter) add(metric *metricClient, index Index, value interface{}) {
+	id := metric.id
+	tags := exporter.tags
+	if len(metric.family) > 0 {
+		id = metric.family
+		tags = append([]string(nil), tags...)
+		for _, label := range metric.labels {
+			tags = append(tags, statsdSanitize(label.Name+":"+label.Value))
+		}
+	}
+	name := exporter.prefix + strings.Replace(statsdSanitize(id), ":", "_", -1)
+
+	if metric.kind == TypeCounter {
+		// a counter is a statsd counter whether or not it is aggregated (its window would be a gauge of the same name)
+		total, plain := value.(int64)
+		if !plain {
+			total = atomic.LoadInt64(&metric.counter)
+		}
+		previous, seen := exporter.counters[index]
+		if !seen {
+			previous = metric.origin // e.g. a restored value was counted before
+		}
+		delta := total - previous
+		exporter.counters[index] = total
+		// note: a counter set back (see Set) sends nothing, the agent's total can not go down,
+		// the increments from the new (lower) total on are sent as usual
+		if delta > 0 {
+			exporter.line(name, strconv.FormatInt(delta, 10), "c", tags)
+		}
+		return
+	}
+
+	switch actual := value.(type) {
+	case int64:
+		exporter.line(name, strconv.FormatInt(actual, 10), "g", tags)
+
+	case float64:
+		exporter.line(name, statsdFloat(actual), "g", tags)
+
+	case WindowValue:
+		exporter.line(name, statsdFloat(actual.Value), "g", tags)
+
+	case string:
+		// info-style: the value goes in a tag
+		exporter.line(name, "1", "g", append(append([]string(nil), tags...), statsdSanitize("value:"+actual)))
+
+	case HistogramValue:
+		exporter.line(name+".count", strconv.FormatUint(actual.Count, 10), "g", tags)
+		exporter.line(name+".sum", statsdFloat(actual.Sum), "g", tags)
+
+	case SummaryValue:
+		exporter.line(name+".count", strconv.FormatUint(actual.Count, 10), "g", tags)
+		exporter.line(name+".sum", statsdFloat(actual.Sum), "g", tags)
+		for _, q := range actual.Quantiles {
+			if !math.IsNaN(q.Value) {
+				quantile := "quantile:" + strconv.FormatFloat(q.Quantile, 'g', -1, 64)
+				exporter.line(name, statsdFloat(q.Value), "g", append(append([]string(nil), tags...), quantile))
+			}
+		}
+	}
+}
+
+// e.g. requests:1|c|#env:prod,method:get
+func (exporter *statsdExporter) line(name, value, kind string, tags []string) {
+	line := name + ":" + value + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+
+	if exporter.batch.Len() > 0 && exporter.batch.Len()+1+len(line) > exporter.maxPacket {
+		exporter.flush()
+	}
+	if exporter.batch.Len() > 0 {
+		exporter.batch.WriteByte('\n')
+	}
+	exporter.batch.WriteString(line)
+}
+
+func (exporter *statsdExporter) flush() {
+	if exporter.batch.Len() == 0 {
+		return
+	}
+	defer exporter.batch.Reset()
+
+	// a missing agent is not worth blocking the sender for
+	exporter.conn.SetWriteDeadline(time.Now().Add(timeoutStatsdWrite))
+	if _, err := exporter.conn.Write(exporter.batch.Bytes()); err != success {
+		warning("failed to send statsd datagram: %v\n", err)
+	}
+}
+
+// note: expects statsdGuard to be locked
+func (exporter *statsdExporter) stop() {
+	exporter.remove()
+	exporter.conn.Close()
+}
+
+// the characters that have a meaning in the datagrams are replaced with '_'
+func statsdSanitize(text string) string {
+	return strings.Map(func(c rune) rune {
+		switch c {
+		case '|', ',', '#', '@', '\n', ' ':
+			return '_'
+		}
+		return c
+	}, text)
+}
+
+func statsdFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the exporter forgets the removed metrics, an aggregated counter is still a statsd counter
+func TestStatsDRemovalsAndAggregatedCounters(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer agent.Close()
+	if err := StartStatsD(agent.LocalAddr().String()); err != success {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer StopStatsD()
+
+	statsdGuard.Lock()
+	exporter := statsdInstance
+	statsdGuard.Unlock()
+
+	churn := createNewMetric("statsd.churn", "Churn", "count", TypeCounter, nil)
+	churn.Add(2)
+	windowed := createNewMetric("statsd.windowed", "Windowed", "count", TypeCounter, nil)
+	SetAggregation(windowed, AggregateSum)
+	defer windowed.Unregister()
+	windowed.Add(3)
+	windowed.Add(4)
+	if err := flushMetrics(5 * time.Second); err != success {
+		t.Fatalf("flush failed: %v", err)
+	}
+	// note: the flush is done once the listeners are (see clientSender)
+	index := churn.currentIndex()
+	if _, found := exporter.counters[index]; !found {
+		t.Fatalf("the counter is not tracked")
+	}
+
+	churn.Unregister()
+	if err := flushMetrics(5 * time.Second); err != success {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if _, found := exporter.counters[index]; found {
+		t.Errorf("the removed counter is still tracked")
+	}
+
+	var lines []string
+	buffer := make([]byte, 65536)
+	agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !containsPrefix(lines, "statsd.windowed:") {
+		n, _, err := agent.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("nothing received for the aggregated counter: %v, received: %q", err, lines)
+		}
+		lines = append(lines, strings.Split(string(buffer[:n]), "\n")...)
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "statsd.windowed:") && !strings.HasPrefix(line, "statsd.windowed:7|c") {
+			t.Errorf("unexpected line of the aggregated counter: %s", line)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nontechno/base"
+	"github.com/nontechno/base/basetest"
+)
+
+const (
+	statsdMaxPacket = 1432 // the default for udp ("statsd.max.packet" is not set)
+)
+
+// an agent reading the datagrams on a local udp socket
+type statsdAgent struct {
+	conn  net.PacketConn
+	sizes []int    // of every datagram received
+	lines []string // of the test metrics (see prefix)
+}
+
+func (agent *statsdAgent) waitFor(t *testing.T, line string) {
+	t.Helper()
+	buffer := make([]byte, 65536)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, received := range agent.lines {
+			if strings.HasPrefix(received, line+"|") {
+				return
+			}
+		}
+		agent.conn.SetReadDeadline(deadline)
+		n, _, err := agent.conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("no (%s) received: %v, received: %q", line, err, agent.lines)
+		}
+		agent.sizes = append(agent.sizes, n)
+		for _, received := range strings.Split(string(buffer[:n]), "\n") {
+			if strings.HasPrefix(received, "statsd.") {
+				agent.lines = append(agent.lines, received)
+			}
+		}
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	kit := basetest.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	agent := &statsdAgent{conn: conn}
+
+	if err := base.StartStatsD("udp://" + conn.LocalAddr().String()); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer base.StopStatsD()
+
+	requests := base.CreateNewCounter("statsd.requests", "Requests", "count")
+	requests.Add(5)
+	agent.waitFor(t, "statsd.requests:5|c")
+
+	requests.Set(2) // set back, the agent is not to be told of a (bogus) increment
+	kit.AssertMetric("statsd.requests", "2")
+	requests.Add(4)
+	agent.waitFor(t, "statsd.requests:4|c")
+
+	for _, line := range agent.lines {
+		if strings.HasPrefix(line, "statsd.requests:") && !strings.HasPrefix(line, "statsd.requests:5|c") && !strings.HasPrefix(line, "statsd.requests:4|c") {
+			t.Errorf("unexpected increment: %s", line)
+		}
+	}
+
+	// more than fits a datagram
+	long := strings.Repeat("x", 64)
+	for i := 0; i < 40; i++ {
+		base.CreateNewGauge(fmt.Sprintf("statsd.%s.%02d", long, i), "Batched", "count").Set(float64(i))
+	}
+	for i := 0; i < 40; i++ {
+		agent.waitFor(t, fmt.Sprintf("statsd.%s.%02d:%d|g", long, i, i))
+	}
+
+	batched := 0
+	for _, line := range agent.lines {
+		if strings.HasPrefix(line, "statsd."+long) {
+			batched++
+		}
+	}
+	if batched != 40 {
+		t.Errorf("received (%d) of the batched gauges, expected (40)", batched)
+	}
+	if len(agent.sizes) < 3 {
+		t.Errorf("expected the batch to take several datagrams, got (%d)", len(agent.sizes))
+	}
+	for _, size := range agent.sizes {
+		if size > statsdMaxPacket {
+			t.Errorf("a datagram of (%d) bytes exceeds (%d)", size, statsdMaxPacket)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	for _, line := range agent.lines {
+		parts := strings.SplitN(line, "|#", 2)
+		if len(parts) != 2 || !strings.Contains(","+parts[1]+",", ",hostname:"+hostname+",") {
+			t.Errorf("the fingerprint tags are missing: %s", line)
+		}
+	}
+}
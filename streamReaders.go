@@ -0,0 +1,223 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	defaultStreamBufferSize = 16 << 20
+)
+
+type (
+	// called (on the receiving thread) when data for a new stream shows up
+	OnNewStream func(id int, reader io.ReadCloser)
+
+	// turns a connection into a set of readers, one per stream id; it implements Connection,
+	// so it can be returned from the NewConnection func:
+	//
+	//	CreateReceiver(port, func(props map[string]interface{}) Connection {
+	//		streams := NewStreamReaders(nil)
+	//		go io.Copy(os.Stdout, streams.Reader(Stdout))
+	//		return streams
+	//	})
+	StreamReaders struct {
+		guard    sync.Mutex
+		pipes    map[int]*streamPipe
+		infos    map[int]StreamInfo
+		names    map[string]int
+		onStream OnNewStream
+		closed   bool
+		limit    int // of a pipe's buffer ("streams.buffer.size")
+	}
+
+	// a buffered pipe: writes never block (so a slow reader does not hold up the other streams);
+	// once the buffer is full, the data is dropped till the reader catches up and gets errStreamOverflow
+	streamPipe struct {
+		guard    sync.Mutex
+		ready    *sync.Cond
+		buffer   []byte
+		limit    int
+		overflow bool // the data is being dropped (see write)
+		eof      bool // the writing side is done
+		closed   bool // the reading side is done
+	}
+)
+
+func NewStreamReaders(onStream OnNewStream) *StreamReaders {
+	return &StreamReaders{
+		pipes:    make(map[int]*streamPipe),
+		infos:    make(map[int]StreamInfo),
+		names:    make(map[string]int),
+		onStream: onStream,
+		limit:    GetInt("streams.buffer.size", 4096, 1<<30, defaultStreamBufferSize),
+	}
+}
+
+// returns the reader for the specified stream, the reader gets io.EOF when the stream is closed
+// by the sender or the connection drops; a stream that was closed before its reader was asked for
+// is still read in full
+func (sr *StreamReaders) Reader(id int) io.ReadCloser {
+	sr.guard.Lock()
+	defer sr.guard.Unlock()
+
+	pipe, _ := sr.pipe(id)
+	return pipe
+}
+
+// returns the id of the named stream (see OpenStream), as announced by the sender
+func (sr *StreamReaders) Lookup(name string) (int, bool) {
+	sr.guard.Lock()
+	defer sr.guard.Unlock()
+
+	id, found := sr.names[name]
+	return id, found
+}
+
+// returns what the sender announced about the stream
+func (sr *StreamReaders) Info(id int) (StreamInfo, bool) {
+	sr.guard.Lock()
+	defer sr.guard.Unlock()
+
+	info, found := sr.infos[id]
+	return info, found
+}
+
+func (sr *StreamReaders) OnNewMessage(id int, data []byte) {
+	switch id {
+	case idFinderPrint:
+		return
+	case Streams:
+		if info, err := ParseStreamInfo(data); err == success {
+			sr.guard.Lock()
+			sr.infos[info.ID] = info
+			sr.names[info.Name] = info.ID
+			sr.guard.Unlock()
+		}
+		return
+	}
+
+	sr.guard.Lock()
+	pipe, created := sr.pipe(id)
+	if len(data) > 0 && pipe.finished() {
+		// the stream was reopened, the finished pipe stays with whoever reads it
+		pipe, created = sr.newPipe(id), true
+	}
+	sr.guard.Unlock()
+
+	if created && sr.onStream != nil {
+		sr.onStream(id, pipe)
+	}
+
+	if len(data) == 0 {
+		pipe.finish()
+	} else {
+		pipe.write(data)
+	}
+}
+
+func (sr *StreamReaders) OnDisconnect(reason error) {
+	sr.guard.Lock()
+	defer sr.guard.Unlock()
+
+	sr.closed = true
+	for _, pipe := range sr.pipes {
+		pipe.finish()
+	}
+}
+
+// note: expects the guard to be locked
+func (sr *StreamReaders) pipe(id int) (*streamPipe, bool) {
+	if pipe, found := sr.pipes[id]; found {
+		return pipe, false
+	}
+	return sr.newPipe(id), true
+}
+
+// note: expects the guard to be locked
+func (sr *StreamReaders) newPipe(id int) *streamPipe {
+	pipe := &streamPipe{limit: sr.limit}
+	pipe.ready = sync.NewCond(&pipe.guard)
+	if sr.closed {
+		pipe.eof = true
+	}
+
+	sr.pipes[id] = pipe
+	return pipe
+}
+
+func (p *streamPipe) Read(b []byte) (int, error) {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+
+	for len(p.buffer) == 0 && !p.overflow && !p.eof && !p.closed {
+		p.ready.Wait()
+	}
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p.buffer) == 0 && p.overflow {
+		p.overflow = false // the data that follows is kept again
+		return 0, errStreamOverflow
+	}
+	if len(p.buffer) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, p.buffer)
+	p.buffer = p.buffer[n:]
+	if len(p.buffer) == 0 {
+		p.buffer = nil
+	}
+	return n, success
+}
+
+func (p *streamPipe) Close() error {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+
+	p.closed = true
+	p.buffer = nil
+	p.ready.Broadcast()
+	return success
+}
+
+func (p *streamPipe) write(data []byte) {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+
+	if p.closed || p.eof {
+		return // nobody is going to read it
+	}
+	if p.overflow || len(p.buffer)+len(data) > p.limit {
+		if !p.overflow {
+			warning("a stream reader fell behind, its data is dropped till it catches up\n")
+		}
+		p.overflow = true
+		p.ready.Broadcast()
+		return
+	}
+
+	p.buffer = append(p.buffer, data...)
+	p.ready.Broadcast()
+}
+
+func (p *streamPipe) finished() bool {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+
+	return p.eof
+}
+
+func (p *streamPipe) finish() {
+	p.guard.Lock()
+	defer p.guard.Unlock()
+
+	p.eof = true
+	p.ready.Broadcast()
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 The NonTechno Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package base
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReaderOfClosedStream(t *testing.T) {
+	streams := NewStreamReaders(nil)
+	streams.OnNewMessage(User, []byte("written "))
+	streams.OnNewMessage(User, []byte("and closed"))
+	streams.OnNewMessage(User, nil)
+
+	// asked for only after the stream was closed
+	data, err := ioutil.ReadAll(streams.Reader(User))
+	if err != success || string(data) != "written and closed" {
+		t.Errorf("read (%s), %v", data, err)
+	}
+}
+
+func TestReopenedStream(t *testing.T) {
+	streams := NewStreamReaders(nil)
+	first := streams.Reader(User)
+	streams.OnNewMessage(User, []byte("first"))
+	streams.OnNewMessage(User, nil)
+	streams.OnNewMessage(User, []byte("second"))
+	second := streams.Reader(User)
+	streams.OnDisconnect(nil)
+
+	if data, _ := ioutil.ReadAll(first); string(data) != "first" {
+		t.Errorf("the first reader got (%s)", data)
+	}
+	if data, _ := ioutil.ReadAll(second); string(data) != "second" {
+		t.Errorf("the second reader got (%s)", data)
+	}
+}
+
+func TestReaderGetsEOFOnDisconnect(t *testing.T) {
+	streams := NewStreamReaders(nil)
+	reader := streams.Reader(Stdout)
+	streams.OnNewMessage(Stdout, []byte("partial"))
+	streams.OnDisconnect(errNotConnected)
+
+	if data, err := ioutil.ReadAll(reader); err != success || string(data) != "partial" {
+		t.Errorf("read (%s), %v", data, err)
+	}
+	if _, err := streams.Reader(Stderr).Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("a reader made after the disconnect returned (%v)", err)
+	}
+}
+
+func TestSlowReaderOverflow(t *testing.T) {
+	streams := NewStreamReaders(nil)
+	streams.limit = 8
+	reader := streams.Reader(User)
+
+	streams.OnNewMessage(User, []byte("12345"))
+	streams.OnNewMessage(User, []byte("6789")) // does not fit, dropped
+	streams.OnNewMessage(User, []byte("0"))    // dropped as well, the reader did not catch up yet
+
+	buffer := make([]byte, 16)
+	if n, err := reader.Read(buffer); err != success || string(buffer[:n]) != "12345" {
+		t.Errorf("read (%s), %v", buffer[:n], err)
+	}
+	if _, err := reader.Read(buffer); err != errStreamOverflow {
+		t.Errorf("expected (%v), got (%v)", errStreamOverflow, err)
+	}
+
+	streams.OnNewMessage(User, []byte("abc"))
+	streams.OnNewMessage(User, nil)
+	if data, err := ioutil.ReadAll(reader); err != success || string(data) != "abc" {
+		t.Errorf("read (%s), %v", data, err)
+	}
+}